@@ -0,0 +1,193 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what an asynchronous Writer does with a new
+// message while its queue is full.
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // wait until there is room
+	OverflowDropNewest                       // discard the new message
+	OverflowDropOldest                       // discard the oldest queued message
+)
+
+// StartAsync makes w asynchronous: WriteMessage (and so Write) only
+// serializes the message and appends it to a queue of up to queueSize
+// messages, from which workers goroutines compress and send them.
+// What happens when the queue is full is decided by policy.  Messages
+// are no longer guaranteed to be sent in order if workers > 1, and
+// send errors are reported to OnError instead of the caller.
+//
+// StartAsync must be called before w is used by other goroutines.
+// Close sends all queued messages before closing the connection, use
+// Flush to wait for them without closing w.
+func (w *Writer) StartAsync(queueSize, workers int, policy OverflowPolicy) error {
+	if w.async != nil {
+		return errors.New("gelf: writer is already asynchronous")
+	}
+	if queueSize < 1 || workers < 1 {
+		return errors.New("gelf: queue size and workers must be positive")
+	}
+
+	a := &asyncQueue{
+		queue:  make(chan []byte, queueSize),
+		done:   make(chan struct{}),
+		policy: policy,
+	}
+	a.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go a.work(w)
+	}
+	w.async = a
+	return nil
+}
+
+// Flush waits until all messages queued by an asynchronous Writer
+// have been sent, or ctx is done.  It returns immediately for a
+// synchronous Writer.
+func (w *Writer) Flush(ctx context.Context) error {
+	if w.async == nil {
+		return nil
+	}
+	return w.async.flush(ctx)
+}
+
+// Dropped returns the number of messages an asynchronous Writer has
+// discarded because its queue was full.
+func (w *Writer) Dropped() uint64 {
+	if w.async == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&w.async.dropped)
+}
+
+type asyncQueue struct {
+	dropped uint64 // accessed atomically, keep 64-bit aligned
+
+	queue  chan []byte
+	policy OverflowPolicy
+	wg     sync.WaitGroup // running workers
+
+	// done is closed to release writers blocked on a full queue,
+	// before queue is closed with mu write-locked.
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.RWMutex
+	closed    bool
+
+	idleMu  sync.Mutex
+	pending int             // messages queued or being sent
+	idle    []chan struct{} // closed once pending drops to 0
+}
+
+func (a *asyncQueue) enqueue(ctx context.Context, b []byte) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return errClosed
+	}
+	a.add(1)
+
+	switch a.policy {
+	case OverflowDropNewest:
+		select {
+		case a.queue <- b:
+		default:
+			a.drop()
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case a.queue <- b:
+				return nil
+			default:
+			}
+			select {
+			case <-a.queue:
+				a.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case a.queue <- b:
+		case <-a.done:
+			a.add(-1)
+			return errClosed
+		case <-ctx.Done():
+			a.add(-1)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (a *asyncQueue) work(w *Writer) {
+	defer a.wg.Done()
+	for b := range a.queue {
+		if err := w.send(context.Background(), b); err != nil && w.OnError != nil {
+			w.OnError(err)
+		}
+		a.add(-1)
+	}
+}
+
+func (a *asyncQueue) drop() {
+	atomic.AddUint64(&a.dropped, 1)
+	a.add(-1)
+}
+
+// add adjusts the number of pending messages and wakes up flushers
+// once there are none left.
+func (a *asyncQueue) add(n int) {
+	a.idleMu.Lock()
+	defer a.idleMu.Unlock()
+	a.pending += n
+	if a.pending == 0 {
+		for _, c := range a.idle {
+			close(c)
+		}
+		a.idle = nil
+	}
+}
+
+func (a *asyncQueue) flush(ctx context.Context) error {
+	a.idleMu.Lock()
+	if a.pending == 0 {
+		a.idleMu.Unlock()
+		return nil
+	}
+	c := make(chan struct{})
+	a.idle = append(a.idle, c)
+	a.idleMu.Unlock()
+
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops accepting messages and waits for the workers to send
+// everything that is still queued.
+func (a *asyncQueue) close() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.mu.Lock()
+		a.closed = true
+		close(a.queue)
+		a.mu.Unlock()
+	})
+	a.wg.Wait()
+}
@@ -0,0 +1,119 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeWriter returns an uncompressed Writer whose messages are read
+// one by one from the returned connection.
+func pipeWriter(t *testing.T) (*Writer, net.Conn) {
+	c1, c2 := net.Pipe()
+	w, err := newWriter(c1, nil)
+	if err != nil {
+		t.Fatalf("newWriter: %s", err)
+	}
+	w.CompressionType = CompressNone
+	return w, c2
+}
+
+func readShort(t *testing.T, conn net.Conn) string {
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	var msg Message
+	if err := json.Unmarshal(buf[:n], &msg); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	return msg.Short
+}
+
+// waitSending waits until the only worker of w has taken the first
+// message off the queue and is blocked sending it.
+func waitSending(w *Writer) {
+	for len(w.async.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAsyncOverflow(t *testing.T) {
+	for _, tt := range []struct {
+		policy OverflowPolicy
+		second string
+	}{
+		{OverflowDropNewest, "b"},
+		{OverflowDropOldest, "d"},
+	} {
+		w, conn := pipeWriter(t)
+		if err := w.StartAsync(1, 1, tt.policy); err != nil {
+			t.Fatalf("StartAsync: %s", err)
+		}
+
+		w.Write([]byte("a"))
+		waitSending(w)
+		for _, s := range []string{"b", "c", "d"} {
+			if _, err := w.Write([]byte(s)); err != nil {
+				t.Fatalf("w.Write: %s", err)
+			}
+		}
+		if d := w.Dropped(); d != 2 {
+			t.Errorf("policy %d: dropped %d messages, expected 2", tt.policy, d)
+		}
+
+		if s := readShort(t, conn); s != "a" {
+			t.Errorf("policy %d: first message %q, expected a", tt.policy, s)
+		}
+		if s := readShort(t, conn); s != tt.second {
+			t.Errorf("policy %d: second message %q, expected %s",
+				tt.policy, s, tt.second)
+		}
+		if err := w.Flush(context.Background()); err != nil {
+			t.Errorf("Flush: %s", err)
+		}
+		w.Close()
+	}
+}
+
+func TestAsyncFlushAndClose(t *testing.T) {
+	w, conn := pipeWriter(t)
+	if err := w.StartAsync(4, 2, OverflowBlock); err != nil {
+		t.Fatalf("StartAsync: %s", err)
+	}
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("w.Write: %s", err)
+		}
+	}
+
+	// nobody reads, so nothing can be sent yet
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Flush: expected deadline exceeded, got %v", err)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- w.Close() }()
+	got := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		got[readShort(t, conn)] = true
+	}
+	if len(got) != 3 {
+		t.Errorf("Close didn't drain the queue, got %v", got)
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	if _, err := w.Write([]byte("late")); err == nil {
+		t.Errorf("Write after Close didn't fail")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// maxChunks is the largest number of chunks a GELF message may be
+// split into.
+const maxChunks = 128
+
+// Defaults for the handling of incomplete chunked messages by a
+// Reader.  Graylog itself discards chunks after 5 seconds.
+const (
+	DefaultChunkTimeout       = 5 * time.Second
+	DefaultMaxPendingMessages = 1000
+)
+
+// Errors wrapped by a ChunkError, describing why a chunk was rejected.
+var (
+	ErrChunkTooShort  = errors.New("shorter than the chunk header")
+	ErrChunkTotal     = errors.New("chunk count out of range")
+	ErrChunkSequence  = errors.New("sequence number out of range")
+	ErrChunkDuplicate = errors.New("duplicate chunk")
+	ErrChunkConflict  = errors.New("conflicts with earlier chunks")
+)
+
+// ChunkError is returned by Reader.ReadMessage for a malformed chunk,
+// or one that doesn't fit the chunks received before with the same
+// message ID.  The chunk is dropped, and on a conflict so is the
+// incomplete message.  The Reader remains usable.
+type ChunkError struct {
+	ID    [8]byte // message ID, zero if the header is cut short
+	Seq   uint8   // sequence number
+	Total uint8   // sequence count
+	Err   error   // one of the ErrChunk errors
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d/%d of message %x: %s",
+		e.Seq, e.Total, e.ID, e.Err)
+}
+
+// Unwrap returns the ErrChunk error describing e.
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// chunkTable reassembles chunked GELF messages.  Chunks of many
+// messages may arrive interleaved, so they are collected per message
+// ID until all chunks of a message are there.
+type chunkTable struct {
+	expired uint64 // accessed atomically, keep 64-bit aligned
+	evicted uint64
+
+	timeout    time.Duration // incomplete messages expire after this
+	maxPending int           // evict the oldest beyond this many
+	maxSize    int           // reassembled size limit
+	now        func() time.Time
+
+	sets  map[[8]byte]*list.Element
+	order *list.List // of *chunkSet, oldest first
+}
+
+// chunkSet holds the chunks of one message received so far.
+type chunkSet struct {
+	id     [8]byte
+	chunks [][]byte // indexed by sequence number
+	got    int      // non-nil entries in chunks
+	length int      // total length of the chunks got
+	first  time.Time
+}
+
+func newChunkTable() *chunkTable {
+	return &chunkTable{
+		timeout:    DefaultChunkTimeout,
+		maxPending: DefaultMaxPendingMessages,
+		now:        time.Now,
+		sets:       make(map[[8]byte]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// add processes a datagram.  A datagram that isn't chunked is returned
+// as is, and a chunk completing a message returns the reassembled
+// message along with its number of chunks.  Otherwise add keeps a
+// copy of the chunk and returns nil.
+func (t *chunkTable) add(datagram []byte) (payload []byte, chunks int, err error) {
+	now := t.now()
+	t.expire(now)
+
+	if !bytes.HasPrefix(datagram, magicChunked) {
+		return datagram, 0, nil
+	}
+	if len(datagram) < chunkedHeaderLen {
+		return nil, 0, &ChunkError{Err: ErrChunkTooShort}
+	}
+
+	var id [8]byte
+	copy(id[:], datagram[2:2+8])
+	seq, total := datagram[2+8], datagram[2+8+1]
+	cerr := func(err error) error {
+		return &ChunkError{ID: id, Seq: seq, Total: total, Err: err}
+	}
+	if total == 0 || total > maxChunks {
+		return nil, 0, cerr(ErrChunkTotal)
+	}
+	if seq >= total {
+		return nil, 0, cerr(ErrChunkSequence)
+	}
+	data := datagram[chunkedHeaderLen:]
+
+	var set *chunkSet
+	if e := t.sets[id]; e != nil {
+		set = e.Value.(*chunkSet)
+		if len(set.chunks) != int(total) {
+			t.remove(e)
+			return nil, 0, cerr(ErrChunkConflict)
+		}
+		if c := set.chunks[seq]; c != nil {
+			if bytes.Equal(c, data) {
+				return nil, 0, cerr(ErrChunkDuplicate)
+			}
+			t.remove(e)
+			return nil, 0, cerr(ErrChunkConflict)
+		}
+	} else {
+		if t.maxPending > 0 && t.order.Len() >= t.maxPending {
+			t.remove(t.order.Front())
+			atomic.AddUint64(&t.evicted, 1)
+		}
+		set = &chunkSet{id: id, chunks: make([][]byte, total), first: now}
+		t.sets[id] = t.order.PushBack(set)
+	}
+	if t.maxSize > 0 && set.length+len(data) > t.maxSize {
+		t.remove(t.sets[id])
+		return nil, 0, &LimitError{Limit: "MaxMessageSize", Max: t.maxSize}
+	}
+	set.chunks[seq] = append(make([]byte, 0, len(data)), data...)
+	set.got++
+	set.length += len(data)
+	if set.got < len(set.chunks) {
+		return nil, 0, nil
+	}
+
+	t.remove(t.sets[id])
+	payload = make([]byte, 0, set.length)
+	for _, c := range set.chunks {
+		payload = append(payload, c...)
+	}
+	return payload, len(set.chunks), nil
+}
+
+// expire drops the messages whose first chunk arrived more than
+// timeout before now.  Sets are ordered by arrival of their first
+// chunk, so only the front of the list needs to be checked.
+func (t *chunkTable) expire(now time.Time) {
+	if t.timeout <= 0 {
+		return
+	}
+	for e := t.order.Front(); e != nil; e = t.order.Front() {
+		if now.Sub(e.Value.(*chunkSet).first) <= t.timeout {
+			return
+		}
+		t.remove(e)
+		atomic.AddUint64(&t.expired, 1)
+	}
+}
+
+// deadline returns when expire will next drop a message, or the zero
+// time if none is pending.  Readers wake up then even if no datagram
+// arrives, so that incomplete messages don't linger on idle sockets.
+func (t *chunkTable) deadline() time.Time {
+	e := t.order.Front()
+	if e == nil || t.timeout <= 0 {
+		return time.Time{}
+	}
+	return e.Value.(*chunkSet).first.Add(t.timeout)
+}
+
+func (t *chunkTable) remove(e *list.Element) {
+	delete(t.sets, e.Value.(*chunkSet).id)
+	t.order.Remove(e)
+}
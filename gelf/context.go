@@ -0,0 +1,102 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, which makes blocked I/O
+// return immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext makes blocking I/O on conn respect ctx: the deadline of
+// ctx is applied to conn, and canceling ctx interrupts pending I/O.
+// The returned function must be called with the result of the I/O
+// once it is done; it clears the deadline again and replaces errors
+// caused by ctx with ctx.Err(); calling it again has no effect.  conn
+// must not be used by others in the meantime.
+func watchContext(ctx context.Context, conn net.Conn) func(error) error {
+	if ctx.Done() == nil {
+		// never canceled, and so without deadline
+		return func(err error) error { return err }
+	}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	stopped := false
+	return func(err error) error {
+		if !stopped {
+			stopped = true
+			close(done)
+			<-exited
+			conn.SetDeadline(time.Time{})
+		}
+		if err == nil {
+			return nil
+		}
+		if cerr := ctxErr(ctx); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// ctxErr is ctx.Err(), but reports a deadline that has passed right
+// away: conn may time out a moment before ctx does.
+func ctxErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// dialTLS is tls.Dial with a context covering both the TCP dial and
+// the TLS handshake.
+func dialTLS(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	// like tls.Dial, verify the host we dialed unless told otherwise
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	conn := tls.Client(raw, config)
+	stop := watchContext(ctx, raw)
+	if err = stop(conn.Handshake()); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Default size limits of a Reader.
+const (
+	DefaultMaxMessageSize      = 1 << 20 // 1 MiB
+	DefaultMaxDecompressedSize = 8 << 20 // 8 MiB
+	DefaultMaxJSONDepth        = 64
+)
+
+// LimitError is returned for a message exceeding one of the size
+// limits of a Reader.
+type LimitError struct {
+	Limit string // name of the limit, such as "MaxMessageSize"
+	Max   int    // its value
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("message exceeds %s (%d)", e.Limit, e.Max)
+}
+
+// limits are the size limits applied by decodeMessage, 0 meaning
+// unlimited, and whether to decode strictly.
+type limits struct {
+	size         int // compressed size
+	decompressed int // decompressed size
+	depth        int // JSON nesting depth
+	strict       bool
+}
+
+// decodeMessage decompresses a complete (reassembled) GELF payload
+// and decodes the message in it.  It also returns the compression
+// the payload turned out to use.
+func decodeMessage(payload []byte, lim limits) (msg *Message, ct CompressType, err error) {
+	var cReader io.Reader
+	if len(payload) < 2 {
+		return nil, CompressNone, fmt.Errorf("message too short (%d bytes)", len(payload))
+	}
+	if lim.size > 0 && len(payload) > lim.size {
+		return nil, CompressNone, &LimitError{Limit: "MaxMessageSize", Max: lim.size}
+	}
+	cHead := payload[:2]
+
+	// the data we get from the wire is compressed
+	if bytes.Equal(cHead, magicGzip) {
+		ct = CompressGzip
+		cReader, err = gzip.NewReader(bytes.NewReader(payload))
+	} else if cHead[0] == magicZlib[0] &&
+		(int(cHead[0])*256+int(cHead[1]))%31 == 0 {
+		// zlib is slightly more complicated, but correct
+		ct = CompressZlib
+		cReader, err = zlib.NewReader(bytes.NewReader(payload))
+	} else {
+		// compliance with https://github.com/Graylog2/graylog2-server
+		// treating all messages as uncompressed if  they are not gzip, zlib or
+		// chunked
+		ct = CompressNone
+		cReader = bytes.NewReader(payload)
+	}
+
+	if err != nil {
+		return nil, ct, fmt.Errorf("NewReader: %s", err)
+	}
+
+	// never inflate more than the limit allows, a few kilobytes of
+	// gzip can expand to gigabytes
+	if lim.decompressed > 0 {
+		cReader = io.LimitReader(cReader, int64(lim.decompressed)+1)
+	}
+	data, err := ioutil.ReadAll(cReader)
+	if err != nil {
+		return nil, ct, fmt.Errorf("decompress: %s", err)
+	}
+	if lim.decompressed > 0 && len(data) > lim.decompressed {
+		return nil, ct, &LimitError{Limit: "MaxDecompressedSize", Max: lim.decompressed}
+	}
+	if lim.depth > 0 && jsonDepth(data) > lim.depth {
+		return nil, ct, &LimitError{Limit: "MaxJSONDepth", Max: lim.depth}
+	}
+
+	msg = new(Message)
+	if err := msg.unmarshal(data, lim.strict); err != nil {
+		if _, ok := err.(*FieldError); ok {
+			return nil, ct, err
+		}
+		return nil, ct, fmt.Errorf("json.Unmarshal: %s", err)
+	}
+
+	return msg, ct, nil
+}
+
+// jsonDepth returns the deepest nesting of objects and arrays in the
+// JSON text data, which need not be valid.
+func jsonDepth(data []byte) int {
+	var depth, max int
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+			if depth > max {
+				max = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return max
+}
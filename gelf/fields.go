@@ -0,0 +1,154 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// fieldSet is a set of additional fields encoded once, to be added to
+// many messages.
+type fieldSet struct {
+	enc   map[string][]byte // "key":value by key
+	order []string          // keys in the order of all
+	all   []byte            // all of enc, comma separated
+}
+
+// newFieldSet encodes fields over those of parent, which may be nil.
+// Field names must be valid GELF additional field names, as checked
+// by Message.Validate, or a *FieldError is returned.
+func newFieldSet(parent *fieldSet, fields map[string]interface{}) (*fieldSet, error) {
+	fs := &fieldSet{enc: make(map[string][]byte, len(fields))}
+	if parent != nil {
+		for k, b := range parent.enc {
+			fs.enc[k] = b
+		}
+	}
+	for k, v := range fields {
+		if reason := checkFieldName(k); reason != "" {
+			return nil, &FieldError{k, v, reason}
+		}
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		vb, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("gelf: field %s: %s", k, err)
+		}
+		fs.enc[k] = append(append(kb, ':'), vb...)
+	}
+
+	for k := range fs.enc {
+		fs.order = append(fs.order, k)
+	}
+	sort.Strings(fs.order)
+	for i, k := range fs.order {
+		if i > 0 {
+			fs.all = append(fs.all, ',')
+		}
+		fs.all = append(fs.all, fs.enc[k]...)
+	}
+	return fs, nil
+}
+
+// SetDefaultFields sets additional fields added to every message
+// sent from now on, such as "_env" or "_service".  Fields of a message
+// take precedence over the defaults.  Names must be valid as checked
+// by Message.Validate and values encodable as JSON; they are encoded
+// once here rather than with every message.  A nil map removes the
+// defaults.
+func (w *Writer) SetDefaultFields(fields map[string]interface{}) error {
+	if len(fields) == 0 {
+		w.defaults.Store((*fieldSet)(nil))
+		return nil
+	}
+	fs, err := newFieldSet(nil, fields)
+	if err != nil {
+		return err
+	}
+	w.defaults.Store(fs)
+	return nil
+}
+
+// defaultFields returns the fields set by SetDefaultFields, or nil.
+func (w *Writer) defaultFields() *fieldSet {
+	fs, _ := w.defaults.Load().(*fieldSet)
+	return fs
+}
+
+// marshal encodes m into buf like m.MarshalJSONBuf, adding the fields
+// in sets which m does not have itself.  Earlier sets take precedence
+// over later ones.
+func (w *Writer) marshal(m *Message, buf *bytes.Buffer, sets ...*fieldSet) error {
+	if err := m.MarshalJSONBuf(buf); err != nil {
+		return err
+	}
+
+	var seen map[string]bool // keys already in the message, if any
+	for i, fs := range sets {
+		if fs == nil || len(fs.all) == 0 {
+			continue
+		}
+		if seen == nil {
+			var err error
+			if seen, err = messageKeys(m); err != nil {
+				return err
+			}
+		}
+
+		// replace the closing brace
+		buf.Truncate(buf.Len() - 1)
+		if !overlaps(fs, seen) {
+			buf.WriteByte(',')
+			buf.Write(fs.all)
+		} else {
+			for _, k := range fs.order {
+				if !seen[k] {
+					buf.WriteByte(',')
+					buf.Write(fs.enc[k])
+				}
+			}
+		}
+		buf.WriteByte('}')
+
+		if i < len(sets)-1 {
+			for k := range fs.enc {
+				seen[k] = true
+			}
+		}
+	}
+	return nil
+}
+
+// messageKeys returns the additional field names of m.
+func messageKeys(m *Message) (map[string]bool, error) {
+	keys := make(map[string]bool, len(m.Extra))
+	for k := range m.Extra {
+		keys[k] = true
+	}
+	if len(m.RawExtra) > 0 {
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(m.RawExtra, &raw); err != nil {
+			return nil, fmt.Errorf("gelf: RawExtra: %s", err)
+		}
+		for k := range raw {
+			keys[k] = true
+		}
+	}
+	return keys, nil
+}
+
+func overlaps(fs *fieldSet, keys map[string]bool) bool {
+	for k := range keys {
+		if _, ok := fs.enc[k]; ok {
+			return true
+		}
+	}
+	return false
+}
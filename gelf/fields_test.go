@@ -0,0 +1,79 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestDefaultFields(t *testing.T) {
+	w := new(Writer)
+	for _, bad := range []string{"env", "_id", "_bad name", "_ü", ""} {
+		err := w.SetDefaultFields(map[string]interface{}{bad: 1})
+		if fe, ok := err.(*FieldError); !ok || fe.Field != bad {
+			t.Errorf("SetDefaultFields(%q): expected FieldError, got %v", bad, err)
+		}
+	}
+	err := w.SetDefaultFields(map[string]interface{}{
+		"_env":     "prod",
+		"_service": "api",
+		"_version": 3,
+	})
+	if err != nil {
+		t.Fatalf("SetDefaultFields: %s", err)
+	}
+
+	for _, tt := range []struct {
+		m        Message
+		expected map[string]interface{}
+	}{
+		{
+			Message{Version: "1.1", Short: "plain"},
+			map[string]interface{}{"_env": "prod", "_service": "api", "_version": int64(3)},
+		},
+		{
+			Message{
+				Version:  "1.1",
+				Short:    "override",
+				Extra:    map[string]interface{}{"_env": "dev"},
+				RawExtra: []byte(`{"_version": 4}`),
+			},
+			map[string]interface{}{"_env": "dev", "_service": "api", "_version": int64(4)},
+		},
+	} {
+		var buf bytes.Buffer
+		if err := w.marshal(&tt.m, &buf, w.defaultFields()); err != nil {
+			t.Fatalf("marshal: %s", err)
+		}
+		// every field once, so no duplicate keys
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &raw); err != nil {
+			t.Fatalf("json.Unmarshal(%s): %s", buf.Bytes(), err)
+		}
+		if n := bytes.Count(buf.Bytes(), []byte(":")); n != len(raw) {
+			t.Errorf("%s: %d fields for %d keys", buf.Bytes(), n, len(raw))
+		}
+
+		var msg Message
+		if err := json.Unmarshal(buf.Bytes(), &msg); err != nil {
+			t.Fatalf("json.Unmarshal(%s): %s", buf.Bytes(), err)
+		}
+		if len(msg.Extra) != len(tt.expected) {
+			t.Errorf("%s: unexpected fields %v", tt.m.Short, msg.Extra)
+		}
+		for k, v := range tt.expected {
+			if msg.Extra[k] != v {
+				t.Errorf("%s: %s expected %v, got %v", tt.m.Short, k, v, msg.Extra[k])
+			}
+		}
+	}
+
+	w.SetDefaultFields(nil)
+	if w.defaultFields() != nil {
+		t.Errorf("defaults not removed")
+	}
+}
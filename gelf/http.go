@@ -0,0 +1,110 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// DefaultMaxRetries is the default MaxRetries of HTTP writers.
+const DefaultMaxRetries = 3
+
+type httpTransport struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPWriter returns a new GELF Writer that POSTs every message to
+// a GELF HTTP input at url, for example "https://graylog:12201/gelf".
+// Messages are compressed according to CompressionType, which is
+// announced in the Content-Encoding header.  Requests are sent with
+// client, so that connections are reused, or with
+// http.DefaultClient if client is nil.
+func NewHTTPWriter(url string, client *http.Client) (*Writer, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	// validate url up front rather than on the first message
+	if _, err := http.NewRequest("POST", url, nil); err != nil {
+		return nil, err
+	}
+
+	w, err := newWriter(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	w.http = &httpTransport{url: url, client: client}
+	w.MaxRetries = DefaultMaxRetries
+	return w, nil
+}
+
+// post sends the compressed message zBytes, retrying up to MaxRetries
+// times.
+func (w *Writer) post(ctx context.Context, zBytes []byte) error {
+	for attempt := 0; ; attempt++ {
+		retry, err := w.postOnce(ctx, zBytes)
+		if err == nil || !retry || attempt >= w.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(w.backoff(attempt + 1)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// postOnce sends a single request, reporting whether it is worth
+// retrying if it failed.
+func (w *Writer) postOnce(ctx context.Context, zBytes []byte) (retry bool, err error) {
+	w.connMu.Lock()
+	closed := w.closed
+	w.connMu.Unlock()
+	if closed {
+		return false, errClosed
+	}
+
+	req, err := http.NewRequest("POST", w.http.url, bytes.NewReader(zBytes))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range w.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	switch w.CompressionType {
+	case CompressGzip:
+		req.Header.Set("Content-Encoding", "gzip")
+	case CompressZlib:
+		// HTTP's "deflate" coding is the zlib format
+		req.Header.Set("Content-Encoding", "deflate")
+	}
+
+	resp, err := w.http.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return true, err
+	}
+	// read the body to the end so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("POST %s: %s", w.http.url, resp.Status)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("POST %s: %s", w.http.url, resp.Status)
+	}
+	return false, nil
+}
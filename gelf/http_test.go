@@ -0,0 +1,93 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPWriter(t *testing.T) {
+	var requests int
+	msgs := make(chan *Message, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(rw, "starting up", http.StatusServiceUnavailable)
+			return
+		}
+		if auth := req.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("Authorization: %q", auth)
+		}
+
+		var body io.Reader = req.Body
+		var err error
+		switch enc := req.Header.Get("Content-Encoding"); enc {
+		case "gzip":
+			body, err = gzip.NewReader(req.Body)
+		case "deflate":
+			body, err = zlib.NewReader(req.Body)
+		case "":
+		default:
+			t.Errorf("unexpected Content-Encoding %q", enc)
+		}
+		if err != nil {
+			t.Errorf("NewReader: %s", err)
+		}
+		msg := new(Message)
+		if err = json.NewDecoder(body).Decode(msg); err != nil {
+			t.Errorf("Decode: %s", err)
+		}
+		msgs <- msg
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	w, err := NewHTTPWriter(srv.URL+"/gelf", nil)
+	if err != nil {
+		t.Fatalf("NewHTTPWriter: %s", err)
+	}
+	w.Header = http.Header{"Authorization": {"Bearer token"}}
+	w.ReconnectDelay = time.Millisecond
+
+	for _, i := range []CompressType{CompressGzip, CompressZlib, CompressNone} {
+		w.CompressionType = i
+		if _, err = w.Write([]byte("over http")); err != nil {
+			t.Fatalf("w.Write: %s", err)
+		}
+		if msg := <-msgs; msg.Short != "over http" {
+			t.Errorf("msg.Short: expected over http, got %s", msg.Short)
+		}
+	}
+	if requests != 4 {
+		t.Errorf("%d requests, expected 4 with one retry", requests)
+	}
+}
+
+func TestHTTPWriterClientError(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		http.Error(rw, "no", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	w, err := NewHTTPWriter(srv.URL+"/gelf", nil)
+	if err != nil {
+		t.Fatalf("NewHTTPWriter: %s", err)
+	}
+	if _, err = w.Write([]byte("rejected")); err == nil {
+		t.Errorf("w.Write didn't fail")
+	}
+	if requests != 1 {
+		t.Errorf("%d requests, 4xx must not be retried", requests)
+	}
+}
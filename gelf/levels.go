@@ -0,0 +1,182 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// leveled implements the leveled methods of Writer and Logger, which
+// both embed it: a Writer with no fields, a Logger with its own.
+type leveled struct {
+	w      *Writer
+	fields *fieldSet
+	err    error // from With, returned by every write
+}
+
+// The leveled methods below send m as a message of the level they are
+// named after, with the host and facility of the writer, the fields
+// of a Logger and the file and line they were called from.  As with
+// Write, the first line of m is the short message, and all of it the
+// full message if there are several lines.  The f variants format m
+// like fmt.Sprintf, and the Extra variants add extra fields, whose
+// names should start with an underscore as in Message.Extra.
+
+// Emerg sends m at level LOG_EMERG (emergency).
+func (l *leveled) Emerg(m string) error {
+	return l.log(1, LOG_EMERG, m, nil)
+}
+
+// Emergf sends a formatted message at level LOG_EMERG.
+func (l *leveled) Emergf(format string, args ...interface{}) error {
+	return l.log(1, LOG_EMERG, fmt.Sprintf(format, args...), nil)
+}
+
+// EmergExtra sends m with extra fields at level LOG_EMERG.
+func (l *leveled) EmergExtra(m string, extra map[string]interface{}) error {
+	return l.log(1, LOG_EMERG, m, extra)
+}
+
+// Alert sends m at level LOG_ALERT (alert).
+func (l *leveled) Alert(m string) error {
+	return l.log(1, LOG_ALERT, m, nil)
+}
+
+// Alertf sends a formatted message at level LOG_ALERT.
+func (l *leveled) Alertf(format string, args ...interface{}) error {
+	return l.log(1, LOG_ALERT, fmt.Sprintf(format, args...), nil)
+}
+
+// AlertExtra sends m with extra fields at level LOG_ALERT.
+func (l *leveled) AlertExtra(m string, extra map[string]interface{}) error {
+	return l.log(1, LOG_ALERT, m, extra)
+}
+
+// Crit sends m at level LOG_CRIT (critical).
+func (l *leveled) Crit(m string) error {
+	return l.log(1, LOG_CRIT, m, nil)
+}
+
+// Critf sends a formatted message at level LOG_CRIT.
+func (l *leveled) Critf(format string, args ...interface{}) error {
+	return l.log(1, LOG_CRIT, fmt.Sprintf(format, args...), nil)
+}
+
+// CritExtra sends m with extra fields at level LOG_CRIT.
+func (l *leveled) CritExtra(m string, extra map[string]interface{}) error {
+	return l.log(1, LOG_CRIT, m, extra)
+}
+
+// Err sends m at level LOG_ERR (error).
+func (l *leveled) Err(m string) error {
+	return l.log(1, LOG_ERR, m, nil)
+}
+
+// Errf sends a formatted message at level LOG_ERR.
+func (l *leveled) Errf(format string, args ...interface{}) error {
+	return l.log(1, LOG_ERR, fmt.Sprintf(format, args...), nil)
+}
+
+// ErrExtra sends m with extra fields at level LOG_ERR.
+func (l *leveled) ErrExtra(m string, extra map[string]interface{}) error {
+	return l.log(1, LOG_ERR, m, extra)
+}
+
+// Warning sends m at level LOG_WARNING (warning).
+func (l *leveled) Warning(m string) error {
+	return l.log(1, LOG_WARNING, m, nil)
+}
+
+// Warningf sends a formatted message at level LOG_WARNING.
+func (l *leveled) Warningf(format string, args ...interface{}) error {
+	return l.log(1, LOG_WARNING, fmt.Sprintf(format, args...), nil)
+}
+
+// WarningExtra sends m with extra fields at level LOG_WARNING.
+func (l *leveled) WarningExtra(m string, extra map[string]interface{}) error {
+	return l.log(1, LOG_WARNING, m, extra)
+}
+
+// Notice sends m at level LOG_NOTICE (notice).
+func (l *leveled) Notice(m string) error {
+	return l.log(1, LOG_NOTICE, m, nil)
+}
+
+// Noticef sends a formatted message at level LOG_NOTICE.
+func (l *leveled) Noticef(format string, args ...interface{}) error {
+	return l.log(1, LOG_NOTICE, fmt.Sprintf(format, args...), nil)
+}
+
+// NoticeExtra sends m with extra fields at level LOG_NOTICE.
+func (l *leveled) NoticeExtra(m string, extra map[string]interface{}) error {
+	return l.log(1, LOG_NOTICE, m, extra)
+}
+
+// Info sends m at level LOG_INFO (informational).
+func (l *leveled) Info(m string) error {
+	return l.log(1, LOG_INFO, m, nil)
+}
+
+// Infof sends a formatted message at level LOG_INFO.
+func (l *leveled) Infof(format string, args ...interface{}) error {
+	return l.log(1, LOG_INFO, fmt.Sprintf(format, args...), nil)
+}
+
+// InfoExtra sends m with extra fields at level LOG_INFO.
+func (l *leveled) InfoExtra(m string, extra map[string]interface{}) error {
+	return l.log(1, LOG_INFO, m, extra)
+}
+
+// Debug sends m at level LOG_DEBUG (debug).
+func (l *leveled) Debug(m string) error {
+	return l.log(1, LOG_DEBUG, m, nil)
+}
+
+// Debugf sends a formatted message at level LOG_DEBUG.
+func (l *leveled) Debugf(format string, args ...interface{}) error {
+	return l.log(1, LOG_DEBUG, fmt.Sprintf(format, args...), nil)
+}
+
+// DebugExtra sends m with extra fields at level LOG_DEBUG.
+func (l *leveled) DebugExtra(m string, extra map[string]interface{}) error {
+	return l.log(1, LOG_DEBUG, m, extra)
+}
+
+// log sends m at level with l's fields, recording the caller
+// callDepth frames up from log's caller.  Fields in extra take
+// precedence over _file and _line.
+func (l *leveled) log(callDepth int, level int32, m string, extra map[string]interface{}) error {
+	if l.err != nil {
+		return l.err
+	}
+	file, line := getCaller(callDepth + 1)
+
+	m = strings.TrimSpace(m)
+	short, full := m, ""
+	if i := strings.IndexByte(m, '\n'); i > 0 {
+		short, full = m[:i], m
+	}
+
+	extraFields := make(map[string]interface{}, len(extra)+2)
+	extraFields["_file"] = file
+	extraFields["_line"] = line
+	for k, v := range extra {
+		extraFields[k] = v
+	}
+
+	w := l.w
+	return w.writeMessage(context.Background(), &Message{
+		Version:  "1.1",
+		Host:     w.hostname,
+		Short:    short,
+		Full:     full,
+		TimeUnix: unixTime(w.now()),
+		Level:    level,
+		Facility: w.Facility,
+		Extra:    extraFields,
+	}, l.fields)
+}
@@ -0,0 +1,107 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeveled(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.Facility = "levels"
+
+	for _, tt := range []struct {
+		send  func() error
+		level int32
+		short string
+		full  string
+		extra map[string]interface{}
+	}{
+		{func() error { return w.Emerg("down") }, LOG_EMERG, "down", "", nil},
+		{func() error { return w.Alertf("%d%%", 99) }, LOG_ALERT, "99%", "", nil},
+		{func() error { return w.Crit("a\nb") }, LOG_CRIT, "a", "a\nb", nil},
+		{func() error { return w.Err("failed") }, LOG_ERR, "failed", "", nil},
+		{func() error { return w.Warningf("%s", "careful") }, LOG_WARNING, "careful", "", nil},
+		{func() error { return w.Notice("notice") }, LOG_NOTICE, "notice", "", nil},
+		{
+			func() error { return w.InfoExtra("hi", map[string]interface{}{"_user": "bob"}) },
+			LOG_INFO, "hi", "", map[string]interface{}{"_user": "bob"},
+		},
+		{
+			func() error { return w.DebugExtra("dbg", map[string]interface{}{"_line": "mine"}) },
+			LOG_DEBUG, "dbg", "", map[string]interface{}{"_line": "mine"},
+		},
+	} {
+		if err := tt.send(); err != nil {
+			t.Fatalf("send %q: %s", tt.short, err)
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Level != tt.level || msg.Short != tt.short || msg.Full != tt.full {
+			t.Errorf("expected %d %q %q, got %d %q %q", tt.level, tt.short, tt.full,
+				msg.Level, msg.Short, msg.Full)
+		}
+		if msg.Host != w.hostname || msg.Facility != "levels" {
+			t.Errorf("host %q, facility %q", msg.Host, msg.Facility)
+		}
+		if file, _ := msg.Extra["_file"].(string); !strings.HasSuffix(file, "/gelf/levels_test.go") {
+			t.Errorf("%q: _file %v", tt.short, msg.Extra["_file"])
+		}
+		if _, ok := tt.extra["_line"]; !ok {
+			if line, _ := msg.Extra["_line"].(int64); line == 0 {
+				t.Errorf("%q: _line %v", tt.short, msg.Extra["_line"])
+			}
+		}
+		for k, v := range tt.extra {
+			if msg.Extra[k] != v {
+				t.Errorf("%q: %s expected %v, got %v", tt.short, k, v, msg.Extra[k])
+			}
+		}
+	}
+}
+
+// tests that LOG_EMERG, being 0, is sent rather than left out, which
+// Graylog would take as LOG_ALERT
+func TestEmergLevelSent(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer pc.Close()
+	w, err := NewWriter(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.CompressionType = CompressNone
+
+	if err := w.Emerg("down"); err != nil {
+		t.Fatalf("Emerg: %s", err)
+	}
+	buf := make([]byte, maxDatagramSize)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	}
+	if !bytes.Contains(buf[:n], []byte(`"level":0`)) {
+		t.Errorf("level missing from %s", buf[:n])
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+)
+
+// Logger sends messages through a Writer with additional fields of its
+// own, such as a request ID.  A Logger is cheap to create, shares the
+// connection of its Writer and is safe for concurrent use.  Its fields
+// take precedence over the default fields of the Writer, and fields of
+// the message over both.
+type Logger struct {
+	leveled
+}
+
+// With returns a Logger adding fields to every message.  Field names
+// must be valid as with SetDefaultFields; otherwise every write
+// through the Logger fails.
+func (w *Writer) With(fields map[string]interface{}) *Logger {
+	return newLogger(w, nil, fields)
+}
+
+// With returns a child Logger adding fields to those of l, replacing
+// any of the same name.
+func (l *Logger) With(fields map[string]interface{}) *Logger {
+	if l.err != nil {
+		return l
+	}
+	return newLogger(l.w, l.fields, fields)
+}
+
+func newLogger(w *Writer, parent *fieldSet, fields map[string]interface{}) *Logger {
+	fs, err := newFieldSet(parent, fields)
+	return &Logger{leveled{w, fs, err}}
+}
+
+// WriteMessage sends m with the fields of l.
+func (l *Logger) WriteMessage(m *Message) error {
+	return l.WriteMessageContext(context.Background(), m)
+}
+
+// WriteMessageContext sends m with the fields of l, giving up once ctx
+// is done as Writer.WriteMessageContext does.
+func (l *Logger) WriteMessageContext(ctx context.Context, m *Message) error {
+	if l.err != nil {
+		return l.err
+	}
+	return l.w.writeMessage(ctx, m, l.fields)
+}
@@ -0,0 +1,112 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.SetDefaultFields(map[string]interface{}{"_env": "prod", "_service": "api"})
+
+	parent := w.With(map[string]interface{}{"_request_id": "r1", "_service": "web"})
+	child := parent.With(map[string]interface{}{"_user": "bob", "_request_id": "r2"})
+
+	for _, tt := range []struct {
+		send     func() error
+		expected map[string]interface{}
+	}{
+		{
+			func() error { return parent.Info("parent") },
+			map[string]interface{}{"_env": "prod", "_service": "web", "_request_id": "r1"},
+		},
+		{
+			func() error { return child.WarningExtra("child", map[string]interface{}{"_user": "alice"}) },
+			map[string]interface{}{"_env": "prod", "_service": "web", "_request_id": "r2", "_user": "alice"},
+		},
+		{
+			func() error { return w.Info("writer") },
+			map[string]interface{}{"_env": "prod", "_service": "api"},
+		},
+	} {
+		if err := tt.send(); err != nil {
+			t.Fatalf("send: %s", err)
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		// everything but _file and _line
+		if len(msg.Extra) != len(tt.expected)+2 {
+			t.Errorf("%s: unexpected fields %v", msg.Short, msg.Extra)
+		}
+		for k, v := range tt.expected {
+			if msg.Extra[k] != v {
+				t.Errorf("%s: %s expected %v, got %v", msg.Short, k, v, msg.Extra[k])
+			}
+		}
+		if file, _ := msg.Extra["_file"].(string); !strings.HasSuffix(file, "/gelf/logger_test.go") {
+			t.Errorf("%s: _file %v", msg.Short, msg.Extra["_file"])
+		}
+	}
+
+	for _, name := range []string{"user", "_user name"} {
+		bad := w.With(map[string]interface{}{name: "bob"})
+		if err := bad.With(nil).Info("x"); err == nil {
+			t.Errorf("Logger with field %q sent a message", name)
+		}
+	}
+}
+
+func TestLoggerConcurrent(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	const n = 8
+	l := w.With(map[string]interface{}{"_app": "test"})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprint(i)
+			if err := l.With(map[string]interface{}{"_request_id": id}).Info(id); err != nil {
+				t.Errorf("Info: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Extra["_request_id"] != msg.Short || msg.Extra["_app"] != "test" {
+			t.Errorf("%s: unexpected fields %v", msg.Short, msg.Extra)
+		}
+	}
+}
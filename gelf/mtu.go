@@ -0,0 +1,51 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import "net"
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	maxIPLen      = 65535 // IPv4 total length, IPv6 payload length
+)
+
+// chunkSize returns the size of the datagrams to send, see ChunkSize
+// and PathMTU.  It never exceeds what fits into a UDP datagram.
+func (w *Writer) chunkSize() int {
+	size := w.ChunkSize
+	if size <= chunkedHeaderLen {
+		size = ChunkSize
+	}
+	if w.PathMTU {
+		if mtu, err := pathMTU(w.conn); err == nil {
+			if n := mtu - ipHeaderLen(w.conn) - udpHeaderLen; n > chunkedHeaderLen {
+				size = n
+			}
+		}
+	}
+	if max := maxUDPPayload(w.conn); size > max {
+		size = max
+	}
+	return size
+}
+
+func ipHeaderLen(conn net.Conn) int {
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6HeaderLen
+	}
+	return ipv4HeaderLen
+}
+
+// maxUDPPayload returns the largest payload of a datagram sent on
+// conn: 65507 bytes over IPv4, whose length limit counts the IP
+// header, and 65527 bytes over IPv6, whose doesn't.
+func maxUDPPayload(conn net.Conn) int {
+	if ipHeaderLen(conn) == ipv6HeaderLen {
+		return maxIPLen - udpHeaderLen
+	}
+	return maxIPLen - ipv4HeaderLen - udpHeaderLen
+}
@@ -0,0 +1,41 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux && go1.9
+// +build linux,go1.9
+
+package gelf
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// pathMTU returns the path MTU the kernel knows for the connected UDP
+// socket conn.  It starts out as the MTU of the outgoing interface and
+// drops as ICMP "fragmentation needed" messages arrive.
+func pathMTU(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errors.New("gelf: no socket for path MTU")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	level, opt := syscall.IPPROTO_IP, syscall.IP_MTU
+	if ipHeaderLen(conn) == ipv6HeaderLen {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MTU
+	}
+	var mtu int
+	cerr := rc.Control(func(fd uintptr) {
+		mtu, err = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return mtu, err
+}
@@ -0,0 +1,115 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux && go1.9
+// +build linux,go1.9
+
+package gelf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathMTU(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.CompressionType = CompressNone
+	w.PathMTU = true
+
+	mtu, err := pathMTU(w.conn)
+	if err != nil {
+		t.Fatalf("pathMTU: %s", err)
+	}
+	size := w.chunkSize()
+	want := mtu - ipv4HeaderLen - udpHeaderLen
+	if max := maxIPLen - ipv4HeaderLen - udpHeaderLen; want > max {
+		want = max
+	}
+	if size != want {
+		t.Fatalf("chunk size %d for MTU %d", size, mtu)
+	}
+	if size <= ChunkSize {
+		t.Skipf("loopback MTU %d too small", mtu)
+	}
+
+	// fits the loopback MTU, so is sent whole
+	short := strings.Repeat("x", ChunkSize)
+	if _, err := w.Write([]byte(short)); err != nil {
+		t.Fatalf("w.Write: %s", err)
+	}
+	msg, meta, err := r.ReadMessageMeta()
+	if err != nil {
+		t.Fatalf("ReadMessageMeta: %s", err)
+	}
+	if msg.Short != short || meta.Chunks != 0 {
+		t.Errorf("sent in %d chunks", meta.Chunks)
+	}
+}
+
+// tests that messages around the largest UDP payload are sent whole or
+// chunked, rather than failing with EMSGSIZE on a 64KiB loopback MTU
+func TestPathMTULimit(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.CompressionType = CompressNone
+	w.PathMTU = true
+
+	mtu, err := pathMTU(w.conn)
+	if err != nil {
+		t.Fatalf("pathMTU: %s", err)
+	}
+	max := maxIPLen - ipv4HeaderLen - udpHeaderLen
+	if mtu-ipv4HeaderLen-udpHeaderLen < max {
+		t.Skipf("loopback MTU %d too small", mtu)
+	}
+
+	for _, tc := range []struct {
+		size   int
+		chunks int
+	}{
+		{max, 0},
+		{max + 1, 2},
+	} {
+		m := Message{Version: "1.1", Host: w.hostname}
+		b, err := w.encode(&m)
+		if err != nil {
+			t.Fatalf("encode: %s", err)
+		}
+		m.Short = strings.Repeat("x", tc.size-len(b))
+		if b, _ = w.encode(&m); len(b) != tc.size {
+			t.Fatalf("encoded %d bytes, want %d", len(b), tc.size)
+		}
+
+		if err := w.WriteMessage(&m); err != nil {
+			t.Fatalf("WriteMessage of %d bytes: %s", tc.size, err)
+		}
+		msg, meta, err := r.ReadMessageMeta()
+		if err != nil {
+			t.Fatalf("ReadMessageMeta: %s", err)
+		}
+		if msg.Short != m.Short {
+			t.Errorf("%d bytes: short message mismatch", tc.size)
+		}
+		if meta.Chunks != tc.chunks {
+			t.Errorf("%d bytes sent in %d chunks, want %d", tc.size, meta.Chunks, tc.chunks)
+		}
+	}
+}
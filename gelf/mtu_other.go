@@ -0,0 +1,17 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux || !go1.9
+// +build !linux !go1.9
+
+package gelf
+
+import (
+	"errors"
+	"net"
+)
+
+func pathMTU(conn net.Conn) (int, error) {
+	return 0, errors.New("gelf: path MTU discovery not supported")
+}
@@ -0,0 +1,185 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// OversizePolicy decides what a UDP Writer does with a message too
+// large for the 128 chunks GELF allows.
+type OversizePolicy int
+
+const (
+	// OversizeError fails the write, losing the message.
+	OversizeError OversizePolicy = iota
+	// OversizeTruncate cuts the full message (or the short one, if
+	// there is no full message) to fit, and marks the message with
+	// a "_truncated" field of 1.
+	OversizeTruncate
+	// OversizeSplit sends the full message (or the short one) in
+	// parts, as messages with the same other fields and a shared
+	// "_split_id".  "_split_index" counts the parts from 1 up to
+	// "_split_total".
+	OversizeSplit
+)
+
+// maxSplits is how many times splitting or truncating may re-estimate
+// the size before giving up.
+const maxSplits = 8
+
+// sendOversized sends the serialized message mBytes, which compressed
+// to zLen bytes is too large to be chunked, as set by w.Oversize.
+// This is rare, so rather than keeping the Message around the
+// serialized one is decoded again.
+func (w *Writer) sendOversized(mBytes []byte, zLen, chunkSize int) error {
+	var m Message
+	if err := json.Unmarshal(mBytes, &m); err != nil {
+		return fmt.Errorf("gelf: oversized message: %s", err)
+	}
+	if m.Extra == nil {
+		m.Extra = make(map[string]interface{}, 4)
+	}
+	limit := maxChunks * (chunkSize - chunkedHeaderLen)
+
+	switch w.Oversize {
+	case OversizeTruncate:
+		m.Extra["_truncated"] = 1
+		return w.sendTruncated(&m, limit, chunkSize)
+	case OversizeSplit:
+		return w.sendSplit(&m, zLen/limit+1, limit, chunkSize)
+	}
+	return fmt.Errorf("gelf: unknown oversize policy %d", w.Oversize)
+}
+
+// sendTruncated cuts the text of m until it compresses to limit bytes
+// at most, and sends it.
+func (w *Writer) sendTruncated(m *Message, limit, chunkSize int) error {
+	text := oversizeText(m)
+	for i := 0; i < maxSplits; i++ {
+		zBytes, err := w.encode(m)
+		if err != nil {
+			return err
+		}
+		if len(zBytes) <= limit {
+			return w.writeDatagrams(zBytes, chunkSize)
+		}
+		if len(*text) == 0 {
+			break
+		}
+		// assume the rest compresses like the text, and aim a
+		// little low
+		keep := float64(len(*text)) * float64(limit) / float64(len(zBytes))
+		*text = cutString(*text, int(keep*0.9))
+	}
+	return fmt.Errorf("gelf: message too large even after truncation")
+}
+
+// sendSplit sends m as several messages, each with a part of its text
+// that compresses to limit bytes at most.  Splitting starts out with
+// the given number of parts, doubled until they are small enough.
+func (w *Writer) sendSplit(m *Message, parts, limit, chunkSize int) error {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return fmt.Errorf("rand.Reader: %s", err)
+	}
+	m.Extra["_split_id"] = hex.EncodeToString(id)
+
+	text := oversizeText(m)
+	whole := *text
+	for i := 0; i < maxSplits; i++ {
+		encoded, ok, err := w.encodeParts(m, text, whole, parts, limit)
+		if err != nil {
+			return err
+		}
+		if ok {
+			for _, zBytes := range encoded {
+				if err = w.writeDatagrams(zBytes, chunkSize); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		parts *= 2
+	}
+	return fmt.Errorf("gelf: message too large even after splitting")
+}
+
+// encodeParts encodes m once for each of n parts of whole, set in
+// *text, and reports whether all of them fit in limit bytes.
+func (w *Writer) encodeParts(m *Message, text *string, whole string, n, limit int) (encoded [][]byte, ok bool, err error) {
+	var parts []string
+	size := (len(whole) + n - 1) / n
+	for rest := whole; len(rest) > 0; {
+		part := cutString(rest, size)
+		if part == "" {
+			// a single rune larger than size
+			_, l := utf8.DecodeRuneInString(rest)
+			part = rest[:l]
+		}
+		parts = append(parts, part)
+		rest = rest[len(part):]
+	}
+
+	m.Extra["_split_total"] = len(parts)
+	for i, part := range parts {
+		*text = part
+		m.Extra["_split_index"] = i + 1
+		zBytes, err := w.encode(m)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(zBytes) > limit {
+			return nil, false, nil
+		}
+		encoded = append(encoded, zBytes)
+	}
+	return encoded, true, nil
+}
+
+// oversizeText returns the field holding the bulk of m: its full
+// message, or the short one if there is none.
+func oversizeText(m *Message) *string {
+	if m.Full != "" {
+		return &m.Full
+	}
+	return &m.Short
+}
+
+// cutString returns the longest prefix of s no longer than n bytes
+// which doesn't split a UTF-8 sequence.
+func cutString(s string, n int) string {
+	if n >= len(s) {
+		return s
+	}
+	if n < 0 {
+		n = 0
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// encode serializes and compresses m, returning a copy.
+func (w *Writer) encode(m *Message) ([]byte, error) {
+	mBuf := newBuffer()
+	defer bufPool.Put(mBuf)
+	if err := m.MarshalJSONBuf(mBuf); err != nil {
+		return nil, err
+	}
+	zBuf := newBuffer()
+	defer bufPool.Put(zBuf)
+	zBytes, err := w.compress(mBuf.Bytes(), zBuf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), zBytes...), nil
+}
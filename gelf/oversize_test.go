@@ -0,0 +1,137 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+// datagramConn decodes the datagrams written to it like a UDP Reader
+// would, without a socket that drops them when written in bursts.
+type datagramConn struct {
+	net.Conn
+	chunks *chunkTable
+	msgs   []*Message
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	payload, _, err := c.chunks.add(append([]byte(nil), b...))
+	if err != nil {
+		return 0, err
+	}
+	if payload != nil {
+		msg, _, err := decodeMessage(payload, newReader().limits())
+		if err != nil {
+			return 0, err
+		}
+		c.msgs = append(c.msgs, msg)
+	}
+	return len(b), nil
+}
+
+func (c *datagramConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12201}
+}
+
+func TestOversize(t *testing.T) {
+	conn := &datagramConn{chunks: newChunkTable()}
+	w, err := newWriter(conn, nil)
+	if err != nil {
+		t.Fatalf("newWriter: %s", err)
+	}
+	// at most 128 chunks of 88 bytes, about 11k
+	w.ChunkSize = 100
+	next := func() *Message {
+		if len(conn.msgs) == 0 {
+			t.Fatalf("no message")
+		}
+		msg := conn.msgs[0]
+		conn.msgs = conn.msgs[1:]
+		return msg
+	}
+
+	// big enough even when compressed
+	rnd := rand.New(rand.NewSource(1))
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d: ünïcödé %x", i, rnd.Int63()))
+	}
+	full := strings.Join(lines, "\n")
+	m := &Message{
+		Version: "1.1",
+		Host:    "h",
+		Short:   "trace",
+		Full:    full,
+		Extra:   map[string]interface{}{"_app": "test"},
+	}
+
+	for _, ct := range []CompressType{CompressNone, CompressGzip} {
+		w.CompressionType = ct
+
+		w.Oversize = OversizeError
+		if err := w.WriteMessage(m); err == nil {
+			t.Errorf("%d: oversized message sent", ct)
+		}
+
+		w.Oversize = OversizeTruncate
+		if err := w.WriteMessage(m); err != nil {
+			t.Fatalf("%d: truncate: %s", ct, err)
+		}
+		msg := next()
+		if msg.Extra["_truncated"] != int64(1) || msg.Extra["_app"] != "test" {
+			t.Errorf("%d: truncated fields %v", ct, msg.Extra)
+		}
+		if err := msg.Validate(); err != nil {
+			t.Errorf("%d: truncated message invalid: %s", ct, err)
+		}
+		if len(msg.Full) == 0 || len(msg.Full) >= len(full) || !strings.HasPrefix(full, msg.Full) {
+			t.Errorf("%d: truncated to %d bytes", ct, len(msg.Full))
+		}
+
+		w.Oversize = OversizeSplit
+		if err := w.WriteMessage(m); err != nil {
+			t.Fatalf("%d: split: %s", ct, err)
+		}
+		var joined string
+		var id interface{}
+		total := 1
+		for i := 1; i <= total; i++ {
+			msg := next()
+			if i == 1 {
+				id = msg.Extra["_split_id"]
+				total = int(msg.Extra["_split_total"].(int64))
+			}
+			if msg.Extra["_split_id"] != id || msg.Extra["_split_index"] != int64(i) ||
+				msg.Short != "trace" || msg.Extra["_app"] != "test" {
+				t.Fatalf("%d: part %d: unexpected %s %v", ct, i, msg.Short, msg.Extra)
+			}
+			joined += msg.Full
+		}
+		if total < 2 || joined != full {
+			t.Errorf("%d: %d parts don't add up", ct, total)
+		}
+	}
+}
+
+func TestCutString(t *testing.T) {
+	for _, tt := range []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 2, "ab"},
+		{"aü", 2, "a"},
+		{"aü", -1, ""},
+	} {
+		if got := cutString(tt.s, tt.n); got != tt.expected {
+			t.Errorf("cutString(%q, %d) = %q, expected %q", tt.s, tt.n, got, tt.expected)
+		}
+	}
+}
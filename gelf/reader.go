@@ -5,20 +5,78 @@
 package gelf
 
 import (
-	"bytes"
-	"compress/gzip"
-	"compress/zlib"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Reader struct {
-	mu   sync.Mutex
-	conn net.Conn
+	skipped uint64 // first for 64-bit alignment, see Stats
+
+	mu     sync.Mutex
+	conn   *net.UDPConn
+	chunks *chunkTable
+	buf    []byte // for datagrams, reused while mu is held
+
+	// ChunkTimeout is how long the chunks of an incomplete message
+	// are kept waiting for the rest.  It defaults to
+	// DefaultChunkTimeout, 0 keeps them until evicted.
+	ChunkTimeout time.Duration
+
+	// MaxPendingMessages caps the number of incomplete messages kept,
+	// beyond which the oldest one is evicted.  It defaults to
+	// DefaultMaxPendingMessages, 0 means no limit.
+	MaxPendingMessages int
+
+	// Limits on the size of messages, guarding against decompression
+	// bombs and other hostile input.  MaxMessageSize caps a message as
+	// received (reassembled, before decompression), and
+	// MaxDecompressedSize its decompressed JSON, in which objects and
+	// arrays may be nested at most MaxJSONDepth deep.  Each defaults
+	// to the corresponding Default constant, 0 means no limit.  A
+	// message beyond a limit is dropped and a *LimitError returned.
+	MaxMessageSize      int
+	MaxDecompressedSize int
+	MaxJSONDepth        int
+
+	// Strict rejects messages not following the GELF specification
+	// with a *FieldError, see Message.UnmarshalJSONStrict.
+	Strict bool
+
+	// SplitNewline makes a TCP Reader accept newline as well as null
+	// byte delimited messages.  Set it before the first ReadMessage.
+	SplitNewline bool
+
+	// Delimiter is written after every message by Read.  It defaults
+	// to a newline.
+	Delimiter []byte
+
+	stream  *streamListener // non-nil for TCP readers
+	results chan readResult // messages decoded by stream
+	closed  int32           // set atomically by Close
+
+	readMu  sync.Mutex // guards pending
+	pending []byte     // text left over by Read
+}
+
+// Meta describes how a message was received.
+type Meta struct {
+	RemoteAddr  net.Addr     // the sender
+	Transport   string       // "udp", "tcp" or "tls"
+	ReceivedAt  time.Time    // arrival of the message, or its last chunk
+	Compression CompressType // as detected from the payload
+	Chunks      int          // number of chunks, 0 if not chunked
+}
+
+// ReaderStats are counters of a Reader, see Reader.Stats.
+type ReaderStats struct {
+	Expired uint64 // incomplete messages dropped after ChunkTimeout
+	Evicted uint64 // incomplete messages dropped for MaxPendingMessages
+	Skipped uint64 // messages Read skipped for an error
 }
 
 func NewReader(addr string) (*Reader, error) {
@@ -33,108 +91,190 @@ func NewReader(addr string) (*Reader, error) {
 		return nil, fmt.Errorf("ListenUDP: %s", err)
 	}
 
-	r := new(Reader)
+	r := newReader()
 	r.conn = conn
 	return r, nil
 }
 
-func (r *Reader) Addr() string {
-	return r.conn.LocalAddr().String()
+func newReader() *Reader {
+	r := new(Reader)
+	r.chunks = newChunkTable()
+	r.ChunkTimeout = DefaultChunkTimeout
+	r.MaxPendingMessages = DefaultMaxPendingMessages
+	r.MaxMessageSize = DefaultMaxMessageSize
+	r.MaxDecompressedSize = DefaultMaxDecompressedSize
+	r.MaxJSONDepth = DefaultMaxJSONDepth
+	r.Delimiter = []byte{'\n'}
+	return r
 }
 
-// FIXME: this will discard data if p isn't big enough to hold the
-// full message.
-func (r *Reader) Read(p []byte) (int, error) {
-	msg, err := r.ReadMessage()
-	if err != nil {
-		return -1, err
+func (r *Reader) limits() limits {
+	return limits{
+		size:         r.MaxMessageSize,
+		decompressed: r.MaxDecompressedSize,
+		depth:        r.MaxJSONDepth,
+		strict:       r.Strict,
 	}
+}
 
-	var data string
+// Stats returns the counters of r.  It may be called while r is in
+// use by another goroutine.
+func (r *Reader) Stats() ReaderStats {
+	return ReaderStats{
+		Expired: atomic.LoadUint64(&r.chunks.expired),
+		Evicted: atomic.LoadUint64(&r.chunks.evicted),
+		Skipped: atomic.LoadUint64(&r.skipped),
+	}
+}
 
-	if msg.Full == "" {
-		data = msg.Short
-	} else {
-		data = msg.Full
+func (r *Reader) Addr() string {
+	if r.stream != nil {
+		return r.stream.listener.Addr().String()
 	}
+	return r.conn.LocalAddr().String()
+}
 
-	return strings.NewReader(data).Read(p)
+// Close stops listening and closes all connections.  A blocked
+// ReadMessage returns with an error.
+func (r *Reader) Close() error {
+	atomic.StoreInt32(&r.closed, 1)
+	if r.stream != nil {
+		return r.stream.close()
+	}
+	return r.conn.Close()
 }
 
-func (r *Reader) ReadMessage() (*Message, error) {
-	cBuf := make([]byte, ChunkSize)
-	var (
-		err        error
-		n, length  int
-		cid, ocid  []byte
-		seq, total uint8
-		cHead      []byte
-		cReader    io.Reader
-		chunks     [][]byte
-	)
-
-	for got := 0; got < 128 && (total == 0 || got < int(total)); got++ {
-		if n, err = r.conn.Read(cBuf); err != nil {
-			return nil, fmt.Errorf("Read: %s", err)
-		}
-		cHead, cBuf = cBuf[:2], cBuf[:n]
-
-		if bytes.Equal(cHead, magicChunked) {
-			//fmt.Printf("chunked %v\n", cBuf[:14])
-			cid, seq, total = cBuf[2:2+8], cBuf[2+8], cBuf[2+8+1]
-			if ocid != nil && !bytes.Equal(cid, ocid) {
-				return nil, fmt.Errorf("out-of-band message %v (awaited %v)", cid, ocid)
-			} else if ocid == nil {
-				ocid = cid
-				chunks = make([][]byte, total)
+// Read implements io.Reader, streaming the text of the messages
+// received, that is Full or, if empty, Short, each followed by
+// Delimiter.  Text that doesn't fit into p is returned by the next
+// calls.  Once the Reader is closed, Read returns io.EOF.
+//
+// Messages that cannot be received or decoded, such as malformed or
+// expired chunks, are skipped and counted in Stats; Read only fails
+// if the Reader cannot go on receiving.
+func (r *Reader) Read(p []byte) (int, error) {
+	r.readMu.Lock()
+	defer r.readMu.Unlock()
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.pending) == 0 {
+		msg, meta, err := r.ReadMessageMeta()
+		if err != nil {
+			if atomic.LoadInt32(&r.closed) != 0 {
+				return 0, io.EOF
 			}
-			n = len(cBuf) - chunkedHeaderLen
-			//fmt.Printf("setting chunks[%d]: %d\n", seq, n)
-			chunks[seq] = append(make([]byte, 0, n), cBuf[chunkedHeaderLen:]...)
-			length += n
-		} else { //not chunked
-			if total > 0 {
-				return nil, fmt.Errorf("out-of-band message (not chunked)")
+			// errors about a message come with its Meta
+			if meta != nil {
+				atomic.AddUint64(&r.skipped, 1)
+				continue
 			}
-			break
+			return 0, err
 		}
-	}
-	//fmt.Printf("\nchunks: %v\n", chunks)
 
-	if length > 0 {
-		if cap(cBuf) < length {
-			cBuf = append(cBuf, make([]byte, 0, length-cap(cBuf))...)
+		data := msg.Full
+		if data == "" {
+			data = msg.Short
 		}
-		cBuf = cBuf[:0]
-		for i := range chunks {
-			//fmt.Printf("appending %d %v\n", i, chunks[i])
-			cBuf = append(cBuf, chunks[i]...)
-		}
-		cHead = cBuf[:2]
+		r.pending = append(append(r.pending[:0], data...), r.Delimiter...)
 	}
 
-	// the data we get from the wire is compressed
-	if bytes.Equal(cHead, magicGzip) {
-		cReader, err = gzip.NewReader(bytes.NewReader(cBuf))
-	} else if cHead[0] == magicZlib[0] &&
-		(int(cHead[0])*256+int(cHead[1]))%31 == 0 {
-		// zlib is slightly more complicated, but correct
-		cReader, err = zlib.NewReader(bytes.NewReader(cBuf))
-	} else {
-		// compliance with https://github.com/Graylog2/graylog2-server
-		// treating all messages as uncompressed if  they are not gzip, zlib or
-		// chunked
-		cReader = bytes.NewReader(cBuf)
-	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("NewReader: %s", err)
+// ReadMessage reads datagrams until a complete message has arrived
+// and returns it.  Chunked messages may interleave: chunks are
+// collected per message ID and a message is returned as soon as its
+// last chunk arrives.  Incomplete messages are dropped as set by
+// ChunkTimeout and MaxPendingMessages.
+//
+// A TCP Reader instead returns the next message received on any of
+// its connections.
+func (r *Reader) ReadMessage() (*Message, error) {
+	return r.ReadMessageContext(context.Background())
+}
+
+// ReadMessageContext is like ReadMessage, but gives up once ctx is
+// done, returning ctx.Err().  Chunks received so far are kept for the
+// next call.
+func (r *Reader) ReadMessageContext(ctx context.Context) (*Message, error) {
+	msg, _, err := r.ReadMessageMetaContext(ctx)
+	return msg, err
+}
+
+// ReadMessageMeta is like ReadMessage, but also returns where and how
+// the message was received.  The Meta is returned as well if the
+// message could not be decoded, to help tracking down the sender; an
+// error without Meta is about the Reader itself, such as its socket
+// failing.
+func (r *Reader) ReadMessageMeta() (*Message, *Meta, error) {
+	return r.ReadMessageMetaContext(context.Background())
+}
+
+// ReadMessageMetaContext is like ReadMessageMeta, but gives up once
+// ctx is done, returning ctx.Err().
+func (r *Reader) ReadMessageMetaContext(ctx context.Context) (*Message, *Meta, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stream != nil {
+		return r.nextStream(ctx)
 	}
 
-	msg := new(Message)
-	if err := json.NewDecoder(cReader).Decode(&msg); err != nil {
-		return nil, fmt.Errorf("json.Unmarshal: %s", err)
+	r.chunks.timeout = r.ChunkTimeout
+	r.chunks.maxPending = r.MaxPendingMessages
+	r.chunks.maxSize = r.MaxMessageSize
+
+	stop := watchContext(ctx, r.conn)
+	defer func() { stop(nil) }()
+
+	// senders may use larger chunks than we would
+	if r.buf == nil {
+		r.buf = make([]byte, maxDatagramSize)
 	}
+	cBuf := r.buf
+	for {
+		// wake up to expire incomplete messages, unless ctx is
+		// done first
+		deadline := r.chunks.deadline()
+		if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+		r.conn.SetReadDeadline(deadline)
+		if err := ctxErr(ctx); err != nil {
+			// canceled before the deadline was replaced
+			return nil, nil, err
+		}
 
-	return msg, nil
+		n, addr, err := r.conn.ReadFrom(cBuf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && ctxErr(ctx) == nil {
+			r.chunks.expire(r.chunks.now())
+			continue
+		}
+		if err != nil {
+			err = stop(err)
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return nil, nil, err
+			}
+			return nil, nil, fmt.Errorf("Read: %s", err)
+		}
+		payload, chunks, err := r.chunks.add(cBuf[:n])
+		if err != nil {
+			return nil, &Meta{RemoteAddr: addr, Transport: "udp", ReceivedAt: time.Now()}, err
+		}
+		if payload != nil {
+			meta := &Meta{
+				RemoteAddr: addr,
+				Transport:  "udp",
+				ReceivedAt: time.Now(),
+				Chunks:     chunks,
+			}
+			msg, ct, err := decodeMessage(payload, r.limits())
+			meta.Compression = ct
+			return msg, meta, err
+		}
+	}
 }
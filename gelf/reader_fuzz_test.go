@@ -0,0 +1,121 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package gelf
+
+import (
+	"strings"
+	"testing"
+)
+
+// datagramSeq encodes datagrams for the fuzz targets below, each
+// prefixed by its length byte.
+func datagramSeq(datagrams ...[]byte) []byte {
+	var b []byte
+	for _, d := range datagrams {
+		b = append(b, byte(len(d)))
+		b = append(b, d...)
+	}
+	return b
+}
+
+// eachDatagram calls fn with each datagram of a sequence encoded by
+// datagramSeq, the last one possibly cut short.
+func eachDatagram(b []byte, fn func(d []byte)) {
+	for len(b) > 0 {
+		n := int(b[0])
+		b = b[1:]
+		if n > len(b) {
+			n = len(b)
+		}
+		fn(b[:n])
+		b = b[n:]
+	}
+}
+
+// FuzzChunkTable feeds a sequence of datagrams, each prefixed by its
+// length byte, to a chunk table.
+func FuzzChunkTable(f *testing.F) {
+	f.Add(datagramSeq([]byte(`{"short_message":"plain"}`)))
+	f.Add(datagramSeq(chunk(1, 1, 2, []byte("b")), chunk(1, 0, 2, []byte("a"))))
+	f.Add(datagramSeq(chunk(1, 0, 2, []byte("a")), chunk(2, 0, 1, []byte("c")), chunk(1, 1, 3, nil)))
+	f.Add(datagramSeq(chunk(1, 5, 2, nil), chunk(1, 0, 0, nil), magicChunked))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		ct := newChunkTable()
+		ct.maxPending = 4
+		eachDatagram(b, func(d []byte) {
+			payload, _, err := ct.add(d)
+			if err != nil && payload != nil {
+				t.Fatalf("add returned both %q and %s", payload, err)
+			}
+		})
+		if len(ct.sets) != ct.order.Len() || len(ct.sets) > ct.maxPending {
+			t.Fatalf("%d sets, %d ordered", len(ct.sets), ct.order.Len())
+		}
+	})
+}
+
+// FuzzDecodeMessage checks that no payload makes decoding panic, and
+// that what strict decoding accepts tolerant decoding does too.
+func FuzzDecodeMessage(f *testing.F) {
+	f.Add([]byte(`{"version":"1.1","host":"h","short_message":"hi","level":3,"_a":1}`))
+	f.Add([]byte(`{"host":123,"level":"3","timestamp":"2017-03-01T12:30:15Z","":null}`))
+	f.Add([]byte(`{"level":1e300,"_x":{"y":[1,2]},"full_message":true}`))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		lim := newReader().limits()
+		_, _, err := decodeMessage(b, lim)
+		lim.strict = true
+		if _, _, serr := decodeMessage(b, lim); serr == nil && err != nil {
+			t.Fatalf("strict decoding accepted what tolerant rejected: %s", err)
+		}
+	})
+}
+
+// FuzzReaderDatagrams feeds a sequence of datagrams, encoded as for
+// FuzzChunkTable, through the steps a UDP Reader takes: reassembly,
+// decompression, size limits and JSON decoding.
+func FuzzReaderDatagrams(f *testing.F) {
+	w, err := newWriter(nil, nil)
+	if err != nil {
+		f.Fatalf("newWriter: %s", err)
+	}
+	encode := func(ct CompressType, short string) []byte {
+		w.CompressionType = ct
+		b, err := w.encode(&Message{Version: "1.1", Host: "h", Short: short, Level: 6})
+		if err != nil {
+			f.Fatalf("encode: %s", err)
+		}
+		return b
+	}
+	gz := encode(CompressGzip, "gzip")
+	f.Add(datagramSeq(encode(CompressNone, "plain")))
+	f.Add(datagramSeq(gz))
+	f.Add(datagramSeq(encode(CompressZlib, "zlib")))
+	f.Add(datagramSeq(chunk(1, 1, 2, gz[10:]), chunk(1, 0, 2, gz[:10])))
+	f.Add(datagramSeq(encode(CompressGzip, strings.Repeat("x", 4000)), gz[:len(gz)-4]))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := newReader()
+		r.MaxMessageSize = 1 << 10
+		r.MaxDecompressedSize = 2 << 10
+		r.MaxJSONDepth = 4
+		r.chunks.maxPending = 4
+		r.chunks.maxSize = r.MaxMessageSize
+		eachDatagram(b, func(d []byte) {
+			payload, _, err := r.chunks.add(d)
+			if err != nil || payload == nil {
+				return
+			}
+			msg, _, err := decodeMessage(payload, r.limits())
+			if (msg == nil) == (err == nil) {
+				t.Fatalf("decodeMessage returned %v and %v", msg, err)
+			}
+		})
+	})
+}
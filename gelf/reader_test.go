@@ -0,0 +1,444 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunk returns a GELF chunk datagram.
+func chunk(id byte, seq, total uint8, data []byte) []byte {
+	b := append([]byte(nil), magicChunked...)
+	b = append(b, id, 0, 0, 0, 0, 0, 0, id)
+	b = append(b, seq, total)
+	return append(b, data...)
+}
+
+// splitChunks cuts payload into total chunks of message id.
+func splitChunks(id byte, total uint8, payload []byte) [][]byte {
+	var chunks [][]byte
+	size := len(payload)/int(total) + 1
+	for i := uint8(0); i < total; i++ {
+		off := int(i) * size
+		end := off + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunks = append(chunks, chunk(id, i, total, payload[off:end]))
+	}
+	return chunks
+}
+
+// tests that the chunks of concurrently sent messages are reassembled
+// per message, in whatever order they arrive
+func TestReadInterleavedChunks(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+
+	a := splitChunks(1, 3, []byte(`{"version":"1.1","host":"a","short_message":"first"}`))
+	b := splitChunks(2, 2, []byte(`{"version":"1.1","host":"b","short_message":"second"}`))
+	for _, d := range [][]byte{a[2], b[1], a[0], b[0], a[1]} {
+		if _, err := conn.Write(d); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+
+	for _, expected := range []string{"second", "first"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+	}
+	if len(r.chunks.sets) != 0 {
+		t.Errorf("%d incomplete messages left", len(r.chunks.sets))
+	}
+}
+
+func TestChunkTableNotChunked(t *testing.T) {
+	d := []byte(`{"short_message":"plain"}`)
+	payload, _, err := newChunkTable().add(d)
+	if err != nil || !bytes.Equal(payload, d) {
+		t.Errorf("add: got %q, %v", payload, err)
+	}
+}
+
+func TestChunkTableExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ct := newChunkTable()
+	ct.maxPending = 2
+	ct.now = func() time.Time { return now }
+
+	for id := byte(1); id <= 3; id++ {
+		if payload, _, err := ct.add(chunk(id, 0, 2, []byte("x"))); payload != nil || err != nil {
+			t.Fatalf("add: got %q, %v", payload, err)
+		}
+		now = now.Add(time.Second)
+	}
+	// the first message was evicted to make room for the third
+	if ct.evicted != 1 || len(ct.sets) != 2 {
+		t.Errorf("evicted %d, %d pending", ct.evicted, len(ct.sets))
+	}
+
+	// the second message expires, the third one completes in time
+	now = time.Unix(1001, 0).Add(DefaultChunkTimeout + time.Second/2)
+	if payload, _, _ := ct.add(chunk(3, 1, 2, []byte("y"))); string(payload) != "xy" {
+		t.Errorf("message not completed: %q", payload)
+	}
+	if ct.expired != 1 || len(ct.sets) != 0 {
+		t.Errorf("expired %d, %d pending", ct.expired, len(ct.sets))
+	}
+}
+
+// tests that incomplete messages expire while only unchunked
+// datagrams arrive, or none at all
+func TestChunkTableExpiryUnchunked(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ct := newChunkTable()
+	ct.now = func() time.Time { return now }
+
+	ct.add(chunk(1, 0, 2, []byte("x")))
+	now = now.Add(DefaultChunkTimeout + time.Second)
+	if payload, _, err := ct.add([]byte("{}")); string(payload) != "{}" || err != nil {
+		t.Fatalf("add: got %q, %v", payload, err)
+	}
+	if ct.expired != 1 || len(ct.sets) != 0 {
+		t.Errorf("expired %d, %d pending", ct.expired, len(ct.sets))
+	}
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	r.ChunkTimeout = 50 * time.Millisecond
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write(chunk(1, 0, 2, []byte("x")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := r.ReadMessageContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("ReadMessageContext: expected deadline exceeded, got %v", err)
+	}
+	if s := r.Stats(); s.Expired != 1 {
+		t.Errorf("expired %d", s.Expired)
+	}
+}
+
+func TestChunkTableRejects(t *testing.T) {
+	ct := newChunkTable()
+	ct.add(chunk(1, 0, 3, []byte("a")))
+	ct.add(chunk(2, 0, 3, []byte("a")))
+
+	for _, tt := range []struct {
+		datagram []byte
+		err      error
+		pending  int
+	}{
+		{magicChunked, ErrChunkTooShort, 2},
+		{chunk(3, 0, 0, nil), ErrChunkTotal, 2},
+		{chunk(3, 0, maxChunks+1, nil), ErrChunkTotal, 2},
+		{chunk(3, 3, 3, nil), ErrChunkSequence, 2},
+		{chunk(1, 0, 3, []byte("a")), ErrChunkDuplicate, 2},
+		{chunk(1, 0, 3, []byte("b")), ErrChunkConflict, 1},
+		{chunk(2, 1, 2, []byte("b")), ErrChunkConflict, 0},
+	} {
+		payload, _, err := ct.add(tt.datagram)
+		if cerr, ok := err.(*ChunkError); !ok || cerr.Err != tt.err || payload != nil {
+			t.Errorf("add(%v): expected %s, got %q, %v", tt.datagram, tt.err, payload, err)
+		}
+		if len(ct.sets) != tt.pending {
+			t.Errorf("add(%v): %d pending, expected %d", tt.datagram, len(ct.sets), tt.pending)
+		}
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write([]byte(`{"short_message":"`))
+	zw.Write(make([]byte, DefaultMaxDecompressedSize))
+	zw.Write([]byte(`"}`))
+	zw.Close()
+
+	deep := strings.Repeat("[", DefaultMaxJSONDepth+1) + strings.Repeat("]", DefaultMaxJSONDepth+1)
+	lim := limits{
+		size:         DefaultMaxMessageSize,
+		decompressed: DefaultMaxDecompressedSize,
+		depth:        DefaultMaxJSONDepth,
+	}
+
+	for _, tt := range []struct {
+		payload []byte
+		limit   string
+	}{
+		{make([]byte, DefaultMaxMessageSize+1), "MaxMessageSize"},
+		{bomb.Bytes(), "MaxDecompressedSize"},
+		{[]byte(`{"short_message":"x","_a":` + deep + `}`), "MaxJSONDepth"},
+	} {
+		_, _, err := decodeMessage(tt.payload, lim)
+		if lerr, ok := err.(*LimitError); !ok || lerr.Limit != tt.limit {
+			t.Errorf("expected %s to be exceeded, got %v", tt.limit, err)
+		}
+	}
+
+	// brackets in strings don't count
+	msg, _, err := decodeMessage([]byte(`{"short_message":"`+deep+`\\"}`), lim)
+	if err != nil || msg.Short != deep+"\\" {
+		t.Errorf("decodeMessage: %v", err)
+	}
+}
+
+func TestChunkTableMaxSize(t *testing.T) {
+	ct := newChunkTable()
+	ct.maxSize = 3
+	ct.add(chunk(1, 0, 2, []byte("ab")))
+	_, _, err := ct.add(chunk(1, 1, 2, []byte("cd")))
+	if lerr, ok := err.(*LimitError); !ok || lerr.Limit != "MaxMessageSize" {
+		t.Errorf("expected MaxMessageSize to be exceeded, got %v", err)
+	}
+	if len(ct.sets) != 0 {
+		t.Errorf("oversized message kept")
+	}
+}
+
+// tests that a TCP Reader receives from several writers at once
+func TestTCPReader(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+
+	for i := 0; i < 3; i++ {
+		w, err := NewTCPWriter(r.Addr())
+		if err != nil {
+			t.Fatalf("NewTCPWriter: %s", err)
+		}
+		defer w.Close()
+		go w.Write([]byte("hello\nfrom tcp"))
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != "hello" || msg.Full != "hello\nfrom tcp" {
+			t.Errorf("unexpected message %+v", msg)
+		}
+	}
+
+	closed := make(chan error)
+	go func() {
+		_, err := r.ReadMessage()
+		closed <- err
+	}()
+	r.Close()
+	if err := <-closed; err != errReaderClosed {
+		t.Errorf("ReadMessage after Close: %v", err)
+	}
+}
+
+func TestTCPReaderNewline(t *testing.T) {
+	r, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer r.Close()
+	r.SplitNewline = true
+
+	conn, err := net.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	conn.Write([]byte("{\"short_message\":\"a\"}\r\n\n{\"short_message\":\"b\"}\x00{\"short_message\":\"c\"}"))
+	conn.Close()
+
+	for _, expected := range []string{"a", "b", "c"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+	}
+}
+
+func TestReadMessageMeta(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	for _, tt := range []struct {
+		compress CompressType
+		size     int
+		chunks   int
+	}{
+		{CompressZlib, 10, 0},
+		{CompressNone, ChunkSize, 2},
+	} {
+		w.CompressionType = tt.compress
+		before := time.Now()
+		if _, err := w.Write(bytes.Repeat([]byte("x"), tt.size)); err != nil {
+			t.Fatalf("w.Write: %s", err)
+		}
+		_, meta, err := r.ReadMessageMeta()
+		if err != nil {
+			t.Fatalf("ReadMessageMeta: %s", err)
+		}
+		if meta.RemoteAddr.String() != w.conn.LocalAddr().String() {
+			t.Errorf("RemoteAddr %s, expected %s", meta.RemoteAddr, w.conn.LocalAddr())
+		}
+		if meta.Transport != "udp" || meta.Compression != tt.compress ||
+			meta.Chunks != tt.chunks || meta.ReceivedAt.Before(before) {
+			t.Errorf("unexpected %+v", meta)
+		}
+	}
+}
+
+func TestReadMessageContext(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := r.ReadMessageContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("ReadMessageContext: expected deadline exceeded, got %v", err)
+	}
+
+	// the deadline must not stick to the connection
+	time.Sleep(30 * time.Millisecond)
+	w.Write([]byte("late"))
+	msg, err := r.ReadMessageContext(context.Background())
+	if err != nil {
+		t.Fatalf("ReadMessageContext: %s", err)
+	}
+	if msg.Short != "late" {
+		t.Errorf("msg.Short: expected late, got %s", msg.Short)
+	}
+
+	tr, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer tr.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := tr.ReadMessageContext(ctx); err != context.Canceled {
+		t.Errorf("TCP ReadMessageContext: expected canceled, got %v", err)
+	}
+}
+
+// tests that Read returns whole messages however small the buffer
+func TestReaderRead(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	r.Delimiter = []byte("\n--\n")
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("a short one"))
+	w.Write([]byte("a long one\nwith two lines"))
+	expected := "a short one\n--\na long one\nwith two lines\n--\n"
+
+	var got []byte
+	p := make([]byte, 3)
+	for len(got) < len(expected) {
+		n, err := r.Read(p)
+		if err != nil {
+			t.Fatalf("Read: %s", err)
+		}
+		got = append(got, p[:n]...)
+	}
+	if string(got) != expected {
+		t.Errorf("Read %q, expected %q", got, expected)
+	}
+
+	r.Close()
+	if n, err := r.Read(p); n != 0 || err != io.EOF {
+		t.Errorf("Read after Close: %d, %v", n, err)
+	}
+}
+
+// tests that a bad datagram doesn't end streaming with io.Copy
+func TestReaderReadSkipsBadMessages(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+
+	pr, pw := io.Pipe()
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(pw, r)
+		pw.Close()
+		copied <- err
+	}()
+
+	conn.Write([]byte(`{"short_message":`))
+	conn.Write(chunk(1, 5, 2, []byte("x")))
+	conn.Write([]byte(`{"version":"1.1","host":"h","short_message":"good"}`))
+	line, err := bufio.NewReader(pr).ReadString('\n')
+	if err != nil || line != "good\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+	if skipped := r.Stats().Skipped; skipped != 2 {
+		t.Errorf("%d messages skipped, expected 2", skipped)
+	}
+
+	r.Close()
+	go ioutil.ReadAll(pr)
+	if err := <-copied; err != nil {
+		t.Errorf("io.Copy: %s", err)
+	}
+}
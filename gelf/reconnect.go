@@ -0,0 +1,186 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Default reconnection policy of TCP and TLS writers.
+const (
+	DefaultReconnectDelay    = 500 * time.Millisecond
+	DefaultMaxReconnectDelay = 30 * time.Second
+)
+
+var errClosed = errors.New("gelf: writer closed")
+
+// dialFunc (re)connects a stream transport.
+type dialFunc func(ctx context.Context) (net.Conn, error)
+
+// writeFrame writes a single null-terminated GELF frame to a stream
+// connection.  Frames must not interleave, so concurrent writers are
+// serialized.
+//
+// If the write fails the connection is dropped and redialed once
+// right away, as the server has most likely just been restarted.  If
+// that fails too, the frame is lost (unless w has a Spool) and further
+// redials are only attempted once the backoff delay has passed; writes
+// in between fail immediately rather than blocking the caller.
+//
+// ctx bounds waiting for other writers as well as dialing and
+// writing.  A write interrupted by ctx may have sent part of the frame,
+// so the connection is dropped.
+func (w *Writer) writeFrame(ctx context.Context, frame []byte) error {
+	if err := w.lock(ctx); err != nil {
+		return err
+	}
+	defer w.unlock()
+
+	if w.Spool != nil {
+		return w.writeSpooled(ctx, frame)
+	}
+	return w.writeFrameLocked(ctx, frame)
+}
+
+// lock acquires w.mu, a channel rather than a sync.Mutex so that
+// waiting for a write stuck dialing or writing gives up once ctx is
+// done.
+func (w *Writer) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case w.mu <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Writer) unlock() {
+	<-w.mu
+}
+
+// writeFrameLocked is writeFrame with w.mu held.
+func (w *Writer) writeFrameLocked(ctx context.Context, frame []byte) error {
+	conn, err := w.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err = writeAll(ctx, conn, frame); err == nil {
+		return nil
+	}
+	w.disconnect(conn, err)
+	if ctxErr(ctx) != nil {
+		return err
+	}
+
+	if conn, err = w.connect(ctx); err != nil {
+		return err
+	}
+	if err = writeAll(ctx, conn, frame); err != nil {
+		w.disconnect(conn, err)
+		return err
+	}
+	return nil
+}
+
+func writeAll(ctx context.Context, conn net.Conn, b []byte) error {
+	stop := watchContext(ctx, conn)
+	n, err := conn.Write(b)
+	if err = stop(err); err != nil {
+		return err
+	}
+	if n != len(b) {
+		return fmt.Errorf("bad write (%d/%d)", n, len(b))
+	}
+	return nil
+}
+
+// connect returns the current connection, redialing if it was lost
+// and the backoff delay has passed.  w.mu must be held.
+func (w *Writer) connect(ctx context.Context) (net.Conn, error) {
+	w.connMu.Lock()
+	conn, closed := w.conn, w.closed
+	w.connMu.Unlock()
+	if closed {
+		return nil, errClosed
+	}
+	if conn != nil {
+		return conn, nil
+	}
+
+	if wait := w.nextDial.Sub(time.Now()); wait > 0 {
+		return nil, fmt.Errorf("reconnect in %s, last error: %s",
+			wait, w.lastError)
+	}
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	conn, err := w.dial(ctx)
+	if err != nil && ctxErr(ctx) != nil {
+		// the caller gave up, not the server: no backoff
+		return nil, ctxErr(ctx)
+	}
+	w.attempts++
+	if err != nil {
+		w.lastError = err
+		w.nextDial = time.Now().Add(w.backoff(w.attempts))
+		return nil, fmt.Errorf("reconnect (attempt %d): %s", w.attempts, err)
+	}
+
+	w.connMu.Lock()
+	if w.closed {
+		w.connMu.Unlock()
+		conn.Close()
+		return nil, errClosed
+	}
+	w.conn = conn
+	w.connMu.Unlock()
+
+	if w.OnReconnect != nil {
+		w.OnReconnect(w.attempts)
+	}
+	w.attempts = 0
+	w.nextDial = time.Time{}
+	return conn, nil
+}
+
+// disconnect drops the broken connection conn.  w.mu must be held.
+func (w *Writer) disconnect(conn net.Conn, err error) {
+	w.connMu.Lock()
+	if w.conn == conn {
+		w.conn = nil
+	}
+	w.connMu.Unlock()
+	conn.Close()
+
+	if w.OnDisconnect != nil {
+		w.OnDisconnect(err)
+	}
+}
+
+// backoff returns how long to wait after the given number of failed
+// dials: ReconnectDelay doubled for every further attempt, capped at
+// MaxReconnectDelay, of which a random half is taken off so that many
+// writers don't redial in lockstep.
+func (w *Writer) backoff(attempts int) time.Duration {
+	d := w.ReconnectDelay
+	for i := 1; i < attempts && d < w.MaxReconnectDelay; i++ {
+		d *= 2
+	}
+	if d > w.MaxReconnectDelay {
+		d = w.MaxReconnectDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
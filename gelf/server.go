@@ -0,0 +1,348 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by the Serve methods of a Server after
+// a call to Shutdown.
+var ErrServerClosed = errors.New("gelf: Server closed")
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 65535
+
+// A Handler processes the messages received by a Server.
+//
+// ServeGELF may be called concurrently, up to the Server's Workers.
+// ctx is canceled if the Server is shut down before all received
+// messages have been handled.
+type Handler interface {
+	ServeGELF(ctx context.Context, m *Message, meta *Meta)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(ctx context.Context, m *Message, meta *Meta)
+
+// ServeGELF calls f(ctx, m, meta).
+func (f HandlerFunc) ServeGELF(ctx context.Context, m *Message, meta *Meta) {
+	f(ctx, m, meta)
+}
+
+// Server receives GELF messages on any number of UDP, TCP and TLS
+// listeners and passes them to its Handler.  Messages are decoded and
+// handled by a pool of worker goroutines shared by all listeners.
+//
+// The exported fields must not be changed once serving has started.
+// The limits and Strict have the same meaning and defaults as those of
+// a Reader.
+type Server struct {
+	Handler Handler
+	Workers int // defaults to the number of CPUs
+
+	// ErrorLog receives messages that could not be read or decoded.
+	// If nil, they are logged with the log package's standard logger.
+	ErrorLog *log.Logger
+
+	ChunkTimeout        time.Duration
+	MaxPendingMessages  int
+	MaxMessageSize      int
+	MaxDecompressedSize int
+	MaxJSONDepth        int
+	Strict              bool
+	SplitNewline        bool
+
+	startOnce sync.Once
+	queue     chan packet
+	quit      chan struct{} // closed when Shutdown gives up waiting
+	ctx       context.Context
+	cancel    context.CancelFunc
+	workers   sync.WaitGroup
+	serving   sync.WaitGroup // Serve calls
+
+	mu          sync.Mutex
+	shutdown    bool
+	listeners   map[*streamListener]struct{}
+	packetConns map[net.PacketConn]struct{}
+}
+
+// packet is a complete, still encoded message queued for the workers.
+type packet struct {
+	payload []byte
+	meta    Meta
+}
+
+// NewServer returns a Server passing messages to h.
+func NewServer(h Handler) *Server {
+	return &Server{
+		Handler:             h,
+		Workers:             runtime.NumCPU(),
+		ChunkTimeout:        DefaultChunkTimeout,
+		MaxPendingMessages:  DefaultMaxPendingMessages,
+		MaxMessageSize:      DefaultMaxMessageSize,
+		MaxDecompressedSize: DefaultMaxDecompressedSize,
+		MaxJSONDepth:        DefaultMaxJSONDepth,
+	}
+}
+
+// ListenAndServeUDP listens on the UDP address addr and serves it.
+func (s *Server) ListenAndServeUDP(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeUDP(pc)
+}
+
+// ListenAndServeTCP listens on the TCP address addr and serves it.
+func (s *Server) ListenAndServeTCP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTCP(l)
+}
+
+// ListenAndServeTLS listens on the TCP address addr and serves TLS
+// connections on it, see ServeTLS.
+func (s *Server) ListenAndServeTLS(addr string, config *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, config)
+}
+
+// ServeUDP reads GELF datagrams, chunked or not, from pc until
+// Shutdown is called, and then returns ErrServerClosed.  pc is
+// closed when ServeUDP returns.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	if !s.track(func() { s.packetConns[pc] = struct{}{} }) {
+		pc.Close()
+		return ErrServerClosed
+	}
+	defer s.serving.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.packetConns, pc)
+		s.mu.Unlock()
+		pc.Close()
+	}()
+
+	chunks := newChunkTable()
+	chunks.timeout = s.ChunkTimeout
+	chunks.maxPending = s.MaxPendingMessages
+	chunks.maxSize = s.MaxMessageSize
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		deadline := chunks.deadline()
+		pc.SetReadDeadline(deadline)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !deadline.IsZero() {
+				chunks.expire(chunks.now())
+				continue
+			}
+			return err
+		}
+		payload, nChunks, err := chunks.add(buf[:n])
+		if err != nil {
+			s.logf("gelf: %s: %s", addr, err)
+			continue
+		}
+		if payload == nil {
+			continue
+		}
+		if len(payload) > 0 && &payload[0] == &buf[0] {
+			// not chunked, so still in buf
+			payload = append([]byte(nil), payload...)
+		}
+		meta := Meta{
+			RemoteAddr: addr,
+			Transport:  "udp",
+			ReceivedAt: time.Now(),
+			Chunks:     nChunks,
+		}
+		if !s.enqueue(packet{payload, meta}) {
+			return ErrServerClosed
+		}
+	}
+}
+
+// ServeTCP accepts GELF TCP connections on l until Shutdown is
+// called, and then returns ErrServerClosed.
+func (s *Server) ServeTCP(l net.Listener) error {
+	return s.serveStream(l, "tcp")
+}
+
+// ServeTLS is like ServeTCP for TLS connections.  config must hold the
+// server's certificates and may require client certificates.
+func (s *Server) ServeTLS(l net.Listener, config *tls.Config) error {
+	return s.serveStream(tls.NewListener(l, config), "tls")
+}
+
+func (s *Server) serveStream(l net.Listener, transport string) error {
+	sl := newStreamListener(l)
+	if !s.track(func() { s.listeners[sl] = struct{}{} }) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.serving.Done()
+
+	err := sl.serve(s.SplitNewline, s.MaxMessageSize, func(frame []byte, remote net.Addr, err error) bool {
+		if err != nil {
+			s.logf("gelf: %s: %s", remote, err)
+			return true
+		}
+		frame = append([]byte(nil), frame...)
+		meta := Meta{RemoteAddr: remote, Transport: transport, ReceivedAt: time.Now()}
+		return s.enqueue(packet{frame, meta})
+	})
+	sl.close()
+	s.mu.Lock()
+	delete(s.listeners, sl)
+	s.mu.Unlock()
+	if err == nil {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// track starts the workers if needed and registers a Serve call with
+// add, unless the server has been shut down.
+func (s *Server) track(add func()) bool {
+	s.startOnce.Do(s.start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	add()
+	s.serving.Add(1)
+	return true
+}
+
+func (s *Server) start() {
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	s.queue = make(chan packet, 64*workers)
+	s.quit = make(chan struct{})
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.listeners = make(map[*streamListener]struct{})
+	s.packetConns = make(map[net.PacketConn]struct{})
+
+	lim := limits{
+		size:         s.MaxMessageSize,
+		decompressed: s.MaxDecompressedSize,
+		depth:        s.MaxJSONDepth,
+		strict:       s.Strict,
+	}
+	s.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work(lim)
+	}
+}
+
+func (s *Server) work(lim limits) {
+	defer s.workers.Done()
+	for p := range s.queue {
+		if s.ctx.Err() != nil {
+			// Shutdown gave up, drop what is left
+			continue
+		}
+		msg, ct, err := decodeMessage(p.payload, lim)
+		if err != nil {
+			s.logf("gelf: %s: %s", p.meta.RemoteAddr, err)
+			continue
+		}
+		meta := p.meta
+		meta.Compression = ct
+		s.Handler.ServeGELF(s.ctx, msg, &meta)
+	}
+}
+
+// enqueue hands p to the workers, reporting false if Shutdown has
+// given up waiting for them.
+func (s *Server) enqueue(p packet) bool {
+	select {
+	case s.queue <- p:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Shutdown stops all listeners and waits until the messages received
+// so far have been handled, or until ctx is done.  In that case the
+// context passed to the Handler is canceled, the remaining messages
+// are dropped and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.startOnce.Do(s.start)
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.shutdown = true
+	for pc := range s.packetConns {
+		pc.Close()
+	}
+	var listeners []*streamListener
+	for sl := range s.listeners {
+		listeners = append(listeners, sl)
+	}
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		for _, sl := range listeners {
+			sl.close()
+		}
+		s.serving.Wait()
+		close(s.queue)
+		s.workers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		close(s.quit)
+		s.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+type received struct {
+	msg  *Message
+	meta *Meta
+}
+
+// tests that a Server serves UDP, TCP and TLS at once and shuts down
+// gracefully
+func TestServer(t *testing.T) {
+	got := make(chan received, 8)
+	s := NewServer(HandlerFunc(func(ctx context.Context, m *Message, meta *Meta) {
+		got <- received{m, meta}
+	}))
+	s.Workers = 2
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	tcpL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	tlsL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	serverConfig, clientConfig := testTLSConfigs(t)
+
+	served := make(chan error, 3)
+	go func() { served <- s.ServeUDP(pc) }()
+	go func() { served <- s.ServeTCP(tcpL) }()
+	go func() { served <- s.ServeTLS(tlsL, serverConfig) }()
+
+	writers := map[string]func() (*Writer, error){
+		"udp": func() (*Writer, error) { return NewWriter(pc.LocalAddr().String()) },
+		"tcp": func() (*Writer, error) { return NewTCPWriter(tcpL.Addr().String()) },
+		"tls": func() (*Writer, error) { return NewTLSWriter(tlsL.Addr().String(), clientConfig) },
+	}
+	for transport, newWriter := range writers {
+		w, err := newWriter()
+		if err != nil {
+			t.Fatalf("%s writer: %s", transport, err)
+		}
+		defer w.Close()
+		if _, err := w.Write([]byte("via " + transport)); err != nil {
+			t.Fatalf("%s write: %s", transport, err)
+		}
+	}
+
+	for i := 0; i < len(writers); i++ {
+		select {
+		case r := <-got:
+			if r.msg.Short != "via "+r.meta.Transport {
+				t.Errorf("%q received over %s", r.msg.Short, r.meta.Transport)
+			}
+			if r.meta.RemoteAddr == nil {
+				t.Errorf("no remote address for %s", r.meta.Transport)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for messages")
+		}
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("Serve returned %v", err)
+		}
+	}
+	if err := s.ServeTCP(tcpL); err != ErrServerClosed {
+		t.Errorf("ServeTCP after Shutdown returned %v", err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	handling := make(chan context.Context, 2)
+	s := NewServer(HandlerFunc(func(ctx context.Context, m *Message, meta *Meta) {
+		handling <- ctx
+		<-release
+	}))
+	s.Workers = 1
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	go s.ServeTCP(l)
+	w, err := NewTCPWriter(l.Addr().String())
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+	w.Write([]byte("stuck"))
+	w.Write([]byte("dropped"))
+
+	// wait for the handler to block, with the second message queued
+	handledCtx := <-handling
+	for len(s.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: expected deadline exceeded, got %v", err)
+	}
+	if handledCtx.Err() == nil {
+		t.Errorf("handler context not canceled")
+	}
+	close(release)
+	time.Sleep(10 * time.Millisecond)
+	if len(handling) != 0 {
+		t.Errorf("queued message handled after Shutdown gave up")
+	}
+}
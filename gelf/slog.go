@@ -0,0 +1,181 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package gelf
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// SlogHandler is a slog.Handler sending records as GELF messages
+// through a Writer.  Levels are mapped to the syslog levels GELF uses,
+// and attributes become additional fields: an attribute "id" in group
+// "req" is sent as "_req.id".  The source location of the log call is
+// recorded in "_file" and "_line", like Writer.Write does.
+type SlogHandler struct {
+	w      *Writer
+	level  slog.Leveler
+	prefix string                 // "_" and the open groups
+	extra  map[string]interface{} // from WithAttrs, never modified
+}
+
+// NewSlogHandler returns a handler sending records of at least level
+// to w.  A nil level means slog.LevelInfo.
+func NewSlogHandler(w *Writer, level slog.Leveler) *SlogHandler {
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	return &SlogHandler{w: w, level: level, prefix: "_"}
+}
+
+// Enabled reports whether records of level are sent.
+func (h *SlogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle sends r as a GELF message, canceled as ctx is.
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	// like Write, the first line is the short message
+	short, full := r.Message, ""
+	if i := strings.IndexByte(r.Message, '\n'); i > 0 {
+		short, full = r.Message[:i], r.Message
+	}
+	t := r.Time
+	if t.IsZero() {
+		t = h.w.now()
+	}
+
+	extra := make(map[string]interface{}, len(h.extra)+r.NumAttrs()+2)
+	for k, v := range h.extra {
+		extra[k] = v
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(extra, h.prefix, a)
+		return true
+	})
+	if r.PC != 0 {
+		f, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		extra["_file"] = f.File
+		extra["_line"] = f.Line
+	}
+
+	m := &Message{
+		Version:  "1.1",
+		Host:     h.w.hostname,
+		Short:    short,
+		Full:     full,
+		TimeUnix: unixTime(t),
+		Level:    slogLevel(r.Level),
+		Facility: h.w.Facility,
+		Extra:    extra,
+	}
+	return h.w.WriteMessageContext(ctx, m)
+}
+
+// WithAttrs returns a handler adding attrs to every record.
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	h2 := *h
+	h2.extra = make(map[string]interface{}, len(h.extra)+len(attrs))
+	for k, v := range h.extra {
+		h2.extra[k] = v
+	}
+	for _, a := range attrs {
+		addAttr(h2.extra, h.prefix, a)
+	}
+	return &h2
+}
+
+// WithGroup returns a handler qualifying all further attributes with
+// name.
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+// addAttr flattens a into extra, with keys starting with prefix.
+// Empty attributes are dropped and groups without a key inlined, as
+// slog.Handler asks for.  A top-level "id" becomes "__id", since
+// Graylog drops messages with an _id field.
+func addAttr(extra map[string]interface{}, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			addAttr(extra, prefix, ga)
+		}
+		return
+	}
+
+	key := prefix + a.Key
+	if key == "_id" {
+		// reserved by Graylog, renamed like Sanitize does
+		key = "__id"
+	}
+	switch v := a.Value; v.Kind() {
+	case slog.KindString:
+		extra[key] = v.String()
+	case slog.KindInt64:
+		extra[key] = v.Int64()
+	case slog.KindUint64:
+		extra[key] = v.Uint64()
+	case slog.KindFloat64:
+		extra[key] = v.Float64()
+	case slog.KindBool:
+		extra[key] = v.Bool()
+	case slog.KindTime:
+		extra[key] = v.Time().Format(time.RFC3339Nano)
+	default:
+		// GELF has no nested values, so anything else is sent
+		// as text, durations included
+		if err, ok := v.Any().(error); ok {
+			extra[key] = err.Error()
+		} else {
+			extra[key] = v.String()
+		}
+	}
+}
+
+// slogLevel maps l to a syslog level.  slog has no levels above
+// error, so every four steps above it go one syslog level up, like
+// the steps between the standard slog levels.
+func slogLevel(l slog.Level) int32 {
+	switch {
+	case l >= slog.LevelError+12:
+		return LOG_EMERG
+	case l >= slog.LevelError+8:
+		return LOG_ALERT
+	case l >= slog.LevelError+4:
+		return LOG_CRIT
+	case l >= slog.LevelError:
+		return LOG_ERR
+	case l >= slog.LevelWarn:
+		return LOG_WARNING
+	case l > slog.LevelInfo:
+		return LOG_NOTICE
+	case l >= slog.LevelInfo:
+		return LOG_INFO
+	default:
+		return LOG_DEBUG
+	}
+}
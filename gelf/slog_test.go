@@ -0,0 +1,92 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+// +build go1.21
+
+package gelf
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlogHandler(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.Facility = "slog"
+
+	logger := slog.New(NewSlogHandler(w, slog.LevelInfo))
+	logger.Debug("not sent")
+	logger.With("id", 7, "user", "bob", slog.Group("", "inline", true)).
+		WithGroup("req").
+		Warn("first\nsecond", "id", 42, slog.Group("net", "ip", "::1"),
+			"err", errors.New("boom"), "took", time.Second)
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "first" || msg.Full != "first\nsecond" {
+		t.Errorf("unexpected message %q / %q", msg.Short, msg.Full)
+	}
+	if msg.Level != LOG_WARNING || msg.Facility != "slog" {
+		t.Errorf("level %d, facility %q", msg.Level, msg.Facility)
+	}
+	if time.Since(time.Unix(0, int64(msg.TimeUnix*1e9))) > time.Minute {
+		t.Errorf("bad timestamp %f", msg.TimeUnix)
+	}
+
+	expected := map[string]interface{}{
+		"__id":        int64(7),
+		"_user":       "bob",
+		"_inline":     true,
+		"_req.id":     int64(42),
+		"_req.net.ip": "::1",
+		"_req.err":    "boom",
+		"_req.took":   "1s",
+	}
+	for k, v := range expected {
+		if msg.Extra[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, msg.Extra[k])
+		}
+	}
+	if _, ok := msg.Extra["_id"]; ok {
+		t.Errorf("_id sent")
+	}
+	if file, _ := msg.Extra["_file"].(string); !strings.HasSuffix(file, "/slog_test.go") {
+		t.Errorf("_file: %v", msg.Extra["_file"])
+	}
+	if line, _ := msg.Extra["_line"].(int64); line == 0 {
+		t.Errorf("_line: %v", msg.Extra["_line"])
+	}
+}
+
+func TestSlogLevel(t *testing.T) {
+	for l, expected := range map[slog.Level]int32{
+		slog.LevelDebug:      LOG_DEBUG,
+		slog.LevelInfo:       LOG_INFO,
+		slog.LevelInfo + 2:   LOG_NOTICE,
+		slog.LevelWarn:       LOG_WARNING,
+		slog.LevelError:      LOG_ERR,
+		slog.LevelError + 4:  LOG_CRIT,
+		slog.LevelError + 8:  LOG_ALERT,
+		slog.LevelError + 12: LOG_EMERG,
+	} {
+		if got := slogLevel(l); got != expected {
+			t.Errorf("slogLevel(%s) = %d, expected %d", l, got, expected)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// spoolFile is the name of the spool file in the spool directory.
+const spoolFile = "gelf.spool"
+
+// Each spooled payload is preceded by a header holding the time it
+// was spooled (Unix nanoseconds) and its length, both big-endian.
+const spoolHeaderLen = 8 + 4
+
+// Spool is an on-disk, first-in first-out store for encoded GELF
+// payloads that a Writer could not deliver.  Payloads are appended to
+// a single file, which is rewritten without the delivered ones after
+// every replay.  A payload may be delivered twice if the process dies
+// during a replay.
+//
+// A Spool must only be used by a single Writer.
+type Spool struct {
+	// MaxSize caps the size of the spool file in bytes.  Payloads
+	// that would grow it further are discarded.  0 means no limit.
+	MaxSize int64
+
+	// MaxAge is how long a payload is kept.  Older payloads are
+	// discarded instead of replayed.  0 means forever.
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	size    int64
+	dropped uint64
+}
+
+// OpenSpool opens the spool kept in dir, creating it if needed.
+// Payloads left over by an earlier process are replayed first.
+func OpenSpool(dir string) (*Spool, error) {
+	s := &Spool{path: filepath.Join(dir, spoolFile)}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) open() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open spool: %s", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat spool: %s", err)
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+// Size returns the size of the spool file in bytes, 0 when nothing is
+// spooled.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Dropped returns the number of payloads discarded because of MaxSize
+// or MaxAge.
+func (s *Spool) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close closes the spool file.  Spooled payloads are kept for the next
+// OpenSpool of the same directory.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// append adds payload to the end of the spool.
+func (s *Spool) append(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+
+	n := int64(spoolHeaderLen + len(payload))
+	if s.MaxSize > 0 && s.size+n > s.MaxSize {
+		s.dropped++
+		return fmt.Errorf("spool full (%d/%d bytes)", s.size, s.MaxSize)
+	}
+	rec := make([]byte, spoolHeaderLen, n)
+	binary.BigEndian.PutUint64(rec, uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(rec[8:], uint32(len(payload)))
+	rec = append(rec, payload...)
+	if _, err := s.f.Write(rec); err != nil {
+		return fmt.Errorf("write spool: %s", err)
+	}
+	s.size += n
+	return nil
+}
+
+// replay passes the spooled payloads to send, oldest first, and
+// removes them from the spool.  It stops at the first error, keeping
+// the payload that failed and all later ones.
+func (s *Spool) replay(send func(payload []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if s.size == 0 {
+		return nil
+	}
+
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek spool: %s", err)
+	}
+	r := bufio.NewReader(s.f)
+	var (
+		off     int64 // start of the first payload still spooled
+		sendErr error
+		head    = make([]byte, spoolHeaderLen)
+		payload []byte
+	)
+	for sendErr == nil {
+		if _, err := io.ReadFull(r, head); err != nil {
+			// EOF, or a record cut short by a crash
+			off = s.size
+			break
+		}
+		spooled := time.Unix(0, int64(binary.BigEndian.Uint64(head)))
+		n := int(binary.BigEndian.Uint32(head[8:]))
+		if int64(n) > s.size-off-spoolHeaderLen {
+			off = s.size
+			break
+		}
+		if cap(payload) < n {
+			payload = make([]byte, n)
+		}
+		payload = payload[:n]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			off = s.size
+			break
+		}
+
+		if s.MaxAge > 0 && time.Since(spooled) > s.MaxAge {
+			s.dropped++
+		} else if sendErr = send(payload); sendErr != nil {
+			break
+		}
+		off += int64(spoolHeaderLen + n)
+	}
+
+	if err := s.truncateFront(off); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// truncateFront removes the first off bytes of the spool file by
+// copying the rest to a new file that replaces it.
+func (s *Spool) truncateFront(off int64) error {
+	if off == 0 {
+		return nil
+	}
+	if off >= s.size {
+		if err := s.f.Truncate(0); err != nil {
+			return fmt.Errorf("truncate spool: %s", err)
+		}
+		s.size = 0
+		return nil
+	}
+
+	tmp, err := os.OpenFile(s.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("rewrite spool: %s", err)
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(s.f, off, s.size-off))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		os.Remove(s.path + ".tmp")
+		return fmt.Errorf("rewrite spool: %s", err)
+	}
+
+	s.f.Close()
+	return s.open()
+}
+
+// writeSpooled writes frame like writeFrameLocked, but first replays
+// what is spooled and spools frame instead of losing it if the server
+// cannot be reached.  w.mu must be held.
+func (w *Writer) writeSpooled(ctx context.Context, frame []byte) error {
+	err := w.Spool.replay(func(payload []byte) error {
+		return w.writeFrameLocked(ctx, payload)
+	})
+	if err == nil {
+		err = w.writeFrameLocked(ctx, frame)
+	}
+	if err == nil {
+		return nil
+	}
+	if serr := w.Spool.append(frame); serr != nil {
+		return fmt.Errorf("%s, and not spooled: %s", err, serr)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempSpool(t *testing.T) *Spool {
+	dir, err := ioutil.TempDir("", "gelf-spool")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	s, err := OpenSpool(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("OpenSpool: %s", err)
+	}
+	return s
+}
+
+func cleanupSpool(s *Spool) {
+	s.Close()
+	os.RemoveAll(filepath.Dir(s.path))
+}
+
+// tests that messages written while the server is down are spooled
+// and sent in order before newer ones once it is back
+func TestSpoolReplay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := l.Addr().String()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	w, err := NewTCPWriter(addr)
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+	w.ReconnectDelay = time.Hour
+	w.MaxReconnectDelay = time.Hour
+	w.Spool = tempSpool(t)
+	defer cleanupSpool(w.Spool)
+
+	l.Close()
+	(<-accepted).Close()
+	// the first writes may still be accepted by the kernel and lost
+	for i := 0; w.Spool.Size() == 0 && i < 100; i++ {
+		if _, err = w.Write([]byte("lost")); err != nil {
+			t.Fatalf("w.Write: %s", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, s := range []string{"one", "two"} {
+		if _, err = w.Write([]byte(s)); err != nil {
+			t.Fatalf("w.Write while down: %s", err)
+		}
+	}
+
+	if l, err = net.Listen("tcp", addr); err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	frames := tcpFrames(l)
+	w.nextDial = time.Time{}
+	if _, err = w.Write([]byte("three")); err != nil {
+		t.Fatalf("w.Write after restart: %s", err)
+	}
+
+	var got []string
+	for len(got) == 0 || got[len(got)-1] != "three" {
+		var msg Message
+		if err := json.Unmarshal(bytes.TrimSuffix(<-frames, []byte{0}), &msg); err != nil {
+			t.Fatalf("json.Unmarshal: %s", err)
+		}
+		got = append(got, msg.Short)
+	}
+	if len(got) < 3 || got[len(got)-3] != "one" || got[len(got)-2] != "two" {
+		t.Errorf("messages not replayed in order: %v", got)
+	}
+	if size := w.Spool.Size(); size != 0 {
+		t.Errorf("%d bytes left in spool", size)
+	}
+}
+
+func TestSpoolLimits(t *testing.T) {
+	s := tempSpool(t)
+	defer cleanupSpool(s)
+	s.MaxSize = 2 * (spoolHeaderLen + 3)
+
+	for _, p := range []string{"one", "two", "six"} {
+		s.append([]byte(p))
+	}
+	if d := s.Dropped(); d != 1 {
+		t.Errorf("dropped %d payloads beyond MaxSize, expected 1", d)
+	}
+
+	// the second send fails, which keeps that payload spooled
+	var sent []string
+	fail := true
+	send := func(p []byte) error {
+		if len(sent) == 1 && fail {
+			fail = false
+			return errClosed
+		}
+		sent = append(sent, string(p))
+		return nil
+	}
+	if err := s.replay(send); err != errClosed {
+		t.Fatalf("replay: expected errClosed, got %v", err)
+	}
+
+	// reopening keeps what was spooled
+	s.Close()
+	if err := s.open(); err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if err := s.replay(send); err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	if len(sent) != 2 || sent[0] != "one" || sent[1] != "two" {
+		t.Errorf("replayed %q", sent)
+	}
+
+	s.MaxAge = time.Nanosecond
+	s.append([]byte("old"))
+	time.Sleep(time.Millisecond)
+	if err := s.replay(send); err != nil || len(sent) != 2 || s.Size() != 0 {
+		t.Errorf("expired payload replayed (%v): %q", err, sent)
+	}
+}
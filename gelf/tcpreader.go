@@ -0,0 +1,229 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var errReaderClosed = errors.New("gelf: reader closed")
+
+// NewTCPReader returns a Reader listening on the TCP address addr for
+// GELF TCP connections, such as those of Docker's gelf log driver.
+// Any number of clients may connect, each sending null byte delimited
+// messages.  Connections are only accepted once ReadMessage is first
+// called.
+func NewTCPReader(addr string) (*Reader, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Listen: %s", err)
+	}
+	r := newReader()
+	r.stream = newStreamListener(l)
+	r.results = make(chan readResult, 64)
+	return r, nil
+}
+
+type readResult struct {
+	msg  *Message
+	meta *Meta
+	err  error
+}
+
+// nextStream returns the next message received on any connection of
+// a TCP Reader.  r.mu must be held.
+func (r *Reader) nextStream(ctx context.Context) (*Message, *Meta, error) {
+	s := r.stream
+	s.start.Do(func() {
+		lim := r.limits()
+		handle := func(frame []byte, remote net.Addr, err error) bool {
+			var msg *Message
+			var meta *Meta
+			// without remote, err is about the listener
+			if remote != nil {
+				meta = &Meta{RemoteAddr: remote, Transport: "tcp", ReceivedAt: time.Now()}
+			}
+			if err == nil {
+				msg, meta.Compression, err = decodeMessage(frame, lim)
+			}
+			select {
+			case r.results <- readResult{msg, meta, err}:
+				return true
+			case <-s.done:
+				return false
+			}
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.serve(r.SplitNewline, lim.size, handle); err != nil {
+				handle(nil, nil, err)
+			}
+		}()
+	})
+
+	select {
+	case res := <-r.results:
+		return res.msg, res.meta, res.err
+	case <-s.done:
+		return nil, nil, errReaderClosed
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// frameHandler is called with every frame received on a stream
+// connection, or an error about it.  It reports whether to go on.
+type frameHandler func(frame []byte, remote net.Addr, err error) bool
+
+// streamListener accepts GELF TCP connections and reads frames from
+// them in a goroutine per connection.
+type streamListener struct {
+	listener net.Listener
+	start    sync.Once
+	done     chan struct{} // closed by close
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func newStreamListener(l net.Listener) *streamListener {
+	return &streamListener{
+		listener: l,
+		done:     make(chan struct{}),
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// serve accepts connections and passes the frames received on them,
+// split on null bytes and optionally newlines, to handle.  Frames
+// longer than maxSize are rejected.  serve returns nil once s is
+// closed.
+func (s *streamListener) serve(newline bool, maxSize int, handle frameHandler) error {
+	split := splitNull
+	if newline {
+		split = splitNullOrNewline
+	}
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("Accept: %s", err)
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		s.wg.Add(1)
+		go s.read(conn, split, maxSize, handle)
+	}
+}
+
+// track registers conn to be closed by close, unless s is already
+// closed.
+func (s *streamListener) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// read passes the frames sent on conn to handle until it is closed.
+func (s *streamListener) read(conn net.Conn, split bufio.SplitFunc, maxSize int, handle frameHandler) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	sc := bufio.NewScanner(conn)
+	sc.Split(split)
+	max := bufio.MaxScanTokenSize
+	if maxSize > 0 {
+		// +1 for the delimiter
+		max = maxSize + 1
+	}
+	sc.Buffer(make([]byte, 0, 4096), max)
+
+	remote := conn.RemoteAddr()
+	for sc.Scan() {
+		frame := sc.Bytes()
+		if len(frame) == 0 {
+			continue
+		}
+		if !handle(frame, remote, nil) {
+			return
+		}
+	}
+	if sc.Err() == bufio.ErrTooLong {
+		handle(nil, remote, &LimitError{Limit: "MaxMessageSize", Max: maxSize})
+	}
+}
+
+// close stops accepting, closes all connections and waits for their
+// goroutines to finish.
+func (s *streamListener) close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	err := s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// splitNull is a bufio.SplitFunc for null byte delimited frames.
+func splitNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return splitAt(data, atEOF, func(b []byte) int {
+		return bytes.IndexByte(b, 0)
+	})
+}
+
+// splitNullOrNewline is a bufio.SplitFunc for frames delimited by a
+// null byte or a newline, with a trailing carriage return removed.
+func splitNullOrNewline(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	advance, token, err = splitAt(data, atEOF, func(b []byte) int {
+		return bytes.IndexAny(b, "\x00\n")
+	})
+	return advance, bytes.TrimSuffix(token, []byte{'\r'}), err
+}
+
+func splitAt(data []byte, atEOF bool, index func([]byte) int) (int, []byte, error) {
+	if i := index(data); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	// a final frame without delimiter
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
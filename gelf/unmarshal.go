@@ -0,0 +1,274 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError is returned for a field of a GELF message that cannot be
+// decoded into a Message, or in strict mode does not follow the GELF
+// specification.
+type FieldError struct {
+	Field  string      // name of the field, such as "level"
+	Value  interface{} // its value as decoded by encoding/json
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("gelf: field %q: %s", e.Field, e.Reason)
+}
+
+// UnmarshalJSONStrict is like UnmarshalJSON, but rejects messages not
+// following the GELF specification: fields of the wrong type, unknown
+// fields without an underscore, additional fields that are neither
+// strings nor numbers, and messages lacking version, host or
+// short_message.
+func (m *Message) UnmarshalJSONStrict(data []byte) error {
+	return m.unmarshal(data, true)
+}
+
+// unmarshal decodes the JSON message data into m.  Unless strict,
+// fields of a different type are converted where that makes sense,
+// such as a level sent as string, and unknown fields are ignored.
+func (m *Message) unmarshal(data []byte, strict bool) error {
+	fields, err := decodeObject(data)
+	if err != nil {
+		return err
+	}
+
+	// in key order, so that of several bad fields the same one is
+	// reported every time, like Validate does
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := fields[k]
+		var err error
+		switch {
+		case k == "":
+			if strict {
+				err = &FieldError{k, v, "empty field name"}
+			}
+		case k[0] == '_':
+			if strict {
+				err = checkAdditional(k, v)
+			}
+			if m.Extra == nil {
+				m.Extra = make(map[string]interface{}, 1)
+			}
+			m.Extra[k] = v
+		case k == "version":
+			m.Version, err = stringField(k, v, strict)
+		case k == "host":
+			m.Host, err = stringField(k, v, strict)
+		case k == "short_message":
+			m.Short, err = stringField(k, v, strict)
+		case k == "full_message":
+			m.Full, err = stringField(k, v, strict)
+		case k == "facility":
+			m.Facility, err = stringField(k, v, strict)
+		case k == "timestamp":
+			m.TimeUnix, err = timestampField(k, v, strict)
+		case k == "level":
+			m.Level, err = levelField(k, v, strict)
+		default:
+			if strict {
+				err = &FieldError{k, v, "unknown field, additional fields must start with _"}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if strict {
+		for _, k := range []string{"version", "host", "short_message"} {
+			if s, _ := fields[k].(string); s == "" {
+				return &FieldError{k, fields[k], "missing"}
+			}
+		}
+	}
+	return nil
+}
+
+// decodeObject decodes the JSON object data, with numbers as by
+// decodeNumbers.  null decodes to a nil map.
+func decodeObject(data []byte) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	for k, v := range fields {
+		fields[k] = decodeNumbers(v)
+	}
+	return fields, nil
+}
+
+// decodeNumbers replaces the json.Numbers in v, as decoded with
+// UseNumber, by int64 for integers and float64 for anything else, so
+// that IDs and nanosecond timestamps in additional fields survive
+// decoding.  Integers too large for int64 are left as json.Number,
+// which encodes back to the same digits.
+func decodeNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if strings.ContainsAny(string(v), ".eE") {
+			if f, err := v.Float64(); err == nil {
+				return f
+			}
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = decodeNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = decodeNumbers(e)
+		}
+	}
+	return v
+}
+
+// number returns v as float64 if it is a decoded number.
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// stringField returns the string v.  Unless strict, numbers and
+// booleans are converted and null is the empty string.
+func stringField(k string, v interface{}, strict bool) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		if !strict {
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		}
+	case int64:
+		if !strict {
+			return strconv.FormatInt(v, 10), nil
+		}
+	case json.Number:
+		if !strict {
+			return string(v), nil
+		}
+	case bool:
+		if !strict {
+			return strconv.FormatBool(v), nil
+		}
+	case nil:
+		if !strict {
+			return "", nil
+		}
+	}
+	return "", &FieldError{k, v, "expected a string, got " + jsonType(v)}
+}
+
+// timestampField returns the timestamp v in seconds since the epoch.
+// Unless strict, it may also be a string holding such a number or an
+// RFC 3339 time, and null is 0.
+func timestampField(k string, v interface{}, strict bool) (float64, error) {
+	if f, ok := number(v); ok {
+		return f, nil
+	}
+	switch v := v.(type) {
+	case string:
+		if strict {
+			break
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, nil
+		}
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return unixTime(t), nil
+		}
+		return 0, &FieldError{k, v, "not a number of seconds or RFC 3339 time"}
+	case nil:
+		if !strict {
+			return 0, nil
+		}
+	}
+	return 0, &FieldError{k, v, "expected a number, got " + jsonType(v)}
+}
+
+// levelField returns the syslog level v.  Unless strict, it may be
+// outside the syslog range of 0 to 7, or a string holding the number,
+// and null is 0.
+func levelField(k string, v interface{}, strict bool) (int32, error) {
+	f, ok := number(v)
+	switch v := v.(type) {
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(v, 64); strict || err != nil {
+			return 0, &FieldError{k, v, "expected a number, got string"}
+		}
+	case nil:
+		if !strict {
+			return 0, nil
+		}
+		return 0, &FieldError{k, v, "expected a number, got null"}
+	default:
+		if !ok {
+			return 0, &FieldError{k, v, "expected a number, got " + jsonType(v)}
+		}
+	}
+
+	if f != math.Trunc(f) || f < math.MinInt32 || f > math.MaxInt32 {
+		return 0, &FieldError{k, v, "not a valid level"}
+	}
+	if strict && (f < float64(LOG_EMERG) || f > float64(LOG_DEBUG)) {
+		return 0, &FieldError{k, v, "not a syslog level (0 to 7)"}
+	}
+	return int32(f), nil
+}
+
+// jsonType names the JSON type of v, as decoded by encoding/json.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, int64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,142 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalTolerant(t *testing.T) {
+	for _, tt := range []struct {
+		data     string
+		expected Message
+	}{
+		{
+			`{"version":"1.1","host":123,"short_message":"hi","level":"3","timestamp":"1488371415.5"}`,
+			Message{Version: "1.1", Host: "123", Short: "hi", Level: 3, TimeUnix: 1488371415.5},
+		},
+		{
+			`{"short_message":true,"timestamp":"2017-03-01T12:30:15.25Z","facility":null}`,
+			Message{Short: "true", TimeUnix: 1488371415.25},
+		},
+		{
+			`{"":1,"short_message":"empty key","unknown":[1]}`,
+			Message{Short: "empty key"},
+		},
+		{`null`, Message{}},
+	} {
+		var m Message
+		if err := json.Unmarshal([]byte(tt.data), &m); err != nil {
+			t.Errorf("%s: %s", tt.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, tt.expected) {
+			t.Errorf("%s: got %+v, expected %+v", tt.data, m, tt.expected)
+		}
+	}
+
+	for _, tt := range []struct{ data, field string }{
+		{`{"level":"high"}`, "level"},
+		{`{"level":1.5}`, "level"},
+		{`{"level":1e10}`, "level"},
+		{`{"host":{"name":"h"}}`, "host"},
+		{`{"timestamp":"yesterday"}`, "timestamp"},
+		{`{"timestamp":[]}`, "timestamp"},
+	} {
+		var m Message
+		err := json.Unmarshal([]byte(tt.data), &m)
+		if fe, ok := err.(*FieldError); !ok || fe.Field != tt.field {
+			t.Errorf("%s: expected error about %s, got %v", tt.data, tt.field, err)
+		}
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	valid := `{"version":"1.1","host":"h","short_message":"hi","timestamp":1.5,"level":7,"_a.b-c":1,"_s":"x"}`
+	var m Message
+	if err := m.UnmarshalJSONStrict([]byte(valid)); err != nil {
+		t.Fatalf("UnmarshalJSONStrict: %s", err)
+	}
+	if m.Level != 7 || m.Extra["_a.b-c"] != int64(1) {
+		t.Errorf("unexpected %+v", m)
+	}
+
+	for _, tt := range []struct{ data, field string }{
+		{`{"version":"1.1","host":123,"short_message":"hi"}`, "host"},
+		{`{"version":"1.1","host":"h","short_message":"hi","level":"3"}`, "level"},
+		{`{"version":"1.1","host":"h","short_message":"hi","level":8}`, "level"},
+		{`{"version":"1.1","host":"h","short_message":"hi","timestamp":"1.5"}`, "timestamp"},
+		{`{"version":"1.1","host":"h","short_message":"hi","extra":1}`, "extra"},
+		{`{"version":"1.1","host":"h","short_message":"hi","":1}`, ""},
+		{`{"version":"1.1","host":"h","short_message":"hi","_id":1}`, "_id"},
+		{`{"version":"1.1","host":"h","short_message":"hi","_a b":1}`, "_a b"},
+		{`{"version":"1.1","host":"h","short_message":"hi","_o":{}}`, "_o"},
+		{`{"version":"1.1","host":"h","short_message":"hi","_t":true}`, "_t"},
+		{`{"version":"1.1","short_message":"hi"}`, "host"},
+		{`{"version":"1.1","host":"h","short_message":""}`, "short_message"},
+	} {
+		var m Message
+		err := m.UnmarshalJSONStrict([]byte(tt.data))
+		if fe, ok := err.(*FieldError); !ok || fe.Field != tt.field {
+			t.Errorf("%s: expected error about %q, got %v", tt.data, tt.field, err)
+		}
+	}
+
+	// of several bad fields, the first in key order is reported
+	several := `{"version":"1.1","host":"h","short_message":"hi","level":"3","extra":1,"_t":true,"timestamp":"x"}`
+	for i := 0; i < 20; i++ {
+		var m Message
+		err := m.UnmarshalJSONStrict([]byte(several))
+		if fe, ok := err.(*FieldError); !ok || fe.Field != "_t" {
+			t.Fatalf("expected error about _t, got %v", err)
+		}
+	}
+
+	// decodeMessage returns the FieldError as is
+	lim := newReader().limits()
+	lim.strict = true
+	if _, _, err := decodeMessage([]byte(`{"version":1}`), lim); err == nil {
+		t.Errorf("decodeMessage accepted version 1")
+	} else if _, ok := err.(*FieldError); !ok {
+		t.Errorf("decodeMessage: %T %s", err, err)
+	}
+}
+
+func TestUnmarshalNumbers(t *testing.T) {
+	data := `{"level":3.0,"timestamp":1488371415,"_user_id":9007199254740993,"_f":1.5,"_e":1e3,` +
+		`"_big":18446744073709551615,"_nested":{"n":[123]}}`
+	var m Message
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if m.Level != 3 || m.TimeUnix != 1488371415 {
+		t.Errorf("level %d, timestamp %f", m.Level, m.TimeUnix)
+	}
+	for k, expected := range map[string]interface{}{
+		"_user_id": int64(9007199254740993),
+		"_f":       1.5,
+		"_e":       float64(1000),
+		"_big":     json.Number("18446744073709551615"),
+		"_nested":  map[string]interface{}{"n": []interface{}{int64(123)}},
+	} {
+		if !reflect.DeepEqual(m.Extra[k], expected) {
+			t.Errorf("%s: expected %#v, got %#v", k, expected, m.Extra[k])
+		}
+	}
+
+	// and encode back to the same digits
+	var mBuf bytes.Buffer
+	if err := m.MarshalJSONBuf(&mBuf); err != nil {
+		t.Fatalf("MarshalJSONBuf: %s", err)
+	}
+	for _, s := range []string{`"_user_id":9007199254740993`, `"_big":18446744073709551615`} {
+		if !bytes.Contains(mBuf.Bytes(), []byte(s)) {
+			t.Errorf("%s not in %s", s, mBuf.Bytes())
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationPolicy decides whether a Writer checks messages against
+// the GELF specification before sending them.  Graylog drops invalid
+// messages without telling the sender.
+type ValidationPolicy int
+
+const (
+	// ValidateNone sends messages as they are.
+	ValidateNone ValidationPolicy = iota
+	// ValidateReject fails writing an invalid message with the
+	// ValidationError of Message.Validate.
+	ValidateReject
+	// ValidateSanitize sends a corrected copy of an invalid message,
+	// see Message.Sanitize.
+	ValidateSanitize
+)
+
+// ValidationError lists what is wrong with a message, one FieldError
+// per field, ordered by field name.
+type ValidationError []*FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks m against the GELF 1.1 specification: version must
+// be "1.1", host and short_message must not be empty, level must be a
+// syslog level, and the names of additional fields must start with an
+// underscore followed by letters, digits, underscores, dots or dashes,
+// _id excepted, with values that are strings or numbers.  This goes
+// for RawExtra as well as Extra.  It returns nil or a ValidationError.
+func (m *Message) Validate() error {
+	var errs ValidationError
+	if m.Version != "1.1" {
+		errs = append(errs, &FieldError{"version", m.Version, `must be "1.1"`})
+	}
+	if strings.TrimSpace(m.Host) == "" {
+		errs = append(errs, &FieldError{"host", m.Host, "missing"})
+	}
+	if strings.TrimSpace(m.Short) == "" {
+		errs = append(errs, &FieldError{"short_message", m.Short, "missing"})
+	}
+	if m.Level < LOG_EMERG || m.Level > LOG_DEBUG {
+		errs = append(errs, &FieldError{"level", m.Level, "not a syslog level (0 to 7)"})
+	}
+
+	for k, v := range m.Extra {
+		if err := checkAdditional(k, v); err != nil {
+			errs = append(errs, err.(*FieldError))
+		}
+	}
+	raw, err := rawExtra(m)
+	if err != nil {
+		errs = append(errs, &FieldError{"RawExtra", string(m.RawExtra), err.Error()})
+	}
+	for k, v := range raw {
+		if err := checkAdditional(k, v); err != nil {
+			errs = append(errs, err.(*FieldError))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+// Sanitize returns a copy of m changed as little as needed to pass
+// Validate: missing version, host and short message are filled in,
+// with hostname as host and the first line of the full message as
+// short one, if any, and the level is clamped to the syslog range.
+// Additional fields get valid names by replacing invalid characters
+// with underscores (a leading one added if missing, _id becoming
+// __id), and values that are neither strings nor numbers are replaced
+// by their text, or dropped if null.  RawExtra is merged into Extra.
+//
+// Fields are never merged: where several names sanitize to the same
+// one, a valid field wins.
+func (m *Message) Sanitize(hostname string) *Message {
+	s := *m
+	s.Version = "1.1"
+	if strings.TrimSpace(s.Host) == "" {
+		s.Host = hostname
+	}
+	if strings.TrimSpace(s.Short) == "" {
+		s.Short = strings.TrimSpace(s.Full)
+		if i := strings.IndexByte(s.Short, '\n'); i > 0 {
+			s.Short = s.Short[:i]
+		}
+		if s.Short == "" {
+			s.Short = "-"
+		}
+	}
+	if s.Level < LOG_EMERG {
+		s.Level = LOG_EMERG
+	} else if s.Level > LOG_DEBUG {
+		s.Level = LOG_DEBUG
+	}
+
+	// RawExtra is encoded after Extra, and so wins where both have
+	// a field
+	raw, _ := rawExtra(m)
+	s.Extra = make(map[string]interface{}, len(m.Extra)+len(raw))
+	s.RawExtra = nil
+	var invalid []string
+	for _, fields := range []map[string]interface{}{raw, m.Extra} {
+		for k, v := range fields {
+			if _, ok := s.Extra[k]; ok {
+				continue
+			}
+			if checkFieldName(k) != "" {
+				invalid = append(invalid, k)
+				continue
+			}
+			if v, ok := sanitizeValue(v); ok {
+				s.Extra[k] = v
+			}
+		}
+	}
+	sort.Strings(invalid)
+	for _, k := range invalid {
+		v, ok := m.Extra[k]
+		if rv, inRaw := raw[k]; inRaw {
+			v, ok = rv, true
+		}
+		name := sanitizeFieldName(k)
+		if _, dup := s.Extra[name]; dup || !ok {
+			continue
+		}
+		if v, ok := sanitizeValue(v); ok {
+			s.Extra[name] = v
+		}
+	}
+	return &s
+}
+
+// checkAdditional checks the additional field k against the GELF
+// specification, returning a *FieldError if it doesn't pass.
+func checkAdditional(k string, v interface{}) error {
+	if reason := checkFieldName(k); reason != "" {
+		return &FieldError{k, v, reason}
+	}
+	if !isGELFValue(v) {
+		return &FieldError{k, v, "expected a string or number, got " + jsonType(v)}
+	}
+	return nil
+}
+
+// checkFieldName returns what is wrong with the additional field name
+// k, or "" if nothing.
+func checkFieldName(k string) string {
+	switch {
+	case k == "_id":
+		return "reserved field name"
+	case !strings.HasPrefix(k, "_"):
+		return "additional field names must start with _"
+	}
+	for _, c := range k[1:] {
+		if !isNameChar(c) {
+			return fmt.Sprintf("invalid character %q in name", c)
+		}
+	}
+	return ""
+}
+
+func isNameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '-'
+}
+
+// sanitizeFieldName makes k a valid additional field name.
+func sanitizeFieldName(k string) string {
+	if k == "_id" {
+		return "__id"
+	}
+	name := strings.Map(func(c rune) rune {
+		if isNameChar(c) {
+			return c
+		}
+		return '_'
+	}, strings.TrimPrefix(k, "_"))
+	return "_" + name
+}
+
+// isGELFValue reports whether v is a string or a finite number.
+func isGELFValue(v interface{}) bool {
+	switch v := v.(type) {
+	case string, json.Number,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64:
+		return true
+	case float64:
+		return !math.IsNaN(v) && !math.IsInf(v, 0)
+	case float32:
+		return !math.IsNaN(float64(v)) && !math.IsInf(float64(v), 0)
+	}
+	return false
+}
+
+// sanitizeValue returns v as string or number, or false if it is nil.
+func sanitizeValue(v interface{}) (interface{}, bool) {
+	if isGELFValue(v) {
+		return v, true
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil, false
+	case bool:
+		return strconv.FormatBool(v), true
+	case error:
+		return v.Error(), true
+	case fmt.Stringer:
+		return v.String(), true
+	case float32, float64:
+		return fmt.Sprint(v), true
+	}
+	if b, err := json.Marshal(v); err == nil {
+		return string(b), true
+	}
+	return fmt.Sprint(v), true
+}
+
+// rawExtra decodes the additional fields in m.RawExtra, if any.
+func rawExtra(m *Message) (map[string]interface{}, error) {
+	if len(m.RawExtra) == 0 {
+		return nil, nil
+	}
+	return decodeObject(m.RawExtra)
+}
@@ -0,0 +1,115 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func invalidMessage() *Message {
+	return &Message{
+		Version: "1.0",
+		Host:    " ",
+		Full:    "\nfirst line\nsecond line",
+		Level:   9,
+		Extra: map[string]interface{}{
+			"_ok":      "fine",
+			"bad name": 1,
+			"_id":      2,
+			"_obj":     map[string]int{"a": 1},
+			"_nan":     math.NaN(),
+			"_nil":     nil,
+		},
+		RawExtra: []byte(`{"_b@d": 3, "_raw": 4}`),
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := &Message{
+		Version:  "1.1",
+		Host:     "h",
+		Short:    "hi",
+		Level:    LOG_DEBUG,
+		Extra:    map[string]interface{}{"_a.b-c_9": uint16(1), "_s": "x"},
+		RawExtra: []byte(`{"_n": 1.5}`),
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate: %s", err)
+	}
+
+	err := invalidMessage().Validate()
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("Validate: expected ValidationError, got %T %v", err, err)
+	}
+	var fields []string
+	for _, fe := range verr {
+		fields = append(fields, fe.Field)
+	}
+	expected := []string{"_b@d", "_id", "_nan", "_nil", "_obj", "bad name",
+		"host", "level", "short_message", "version"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("errors about %q, expected %q", fields, expected)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	m := invalidMessage()
+	s := m.Sanitize("fallback")
+	if err := s.Validate(); err != nil {
+		t.Fatalf("sanitized message invalid: %s", err)
+	}
+	if s.Version != "1.1" || s.Host != "fallback" || s.Short != "first line" ||
+		s.Level != LOG_DEBUG {
+		t.Errorf("unexpected %+v", s)
+	}
+
+	expected := map[string]interface{}{
+		"_ok":       "fine",
+		"_bad_name": 1,
+		"__id":      2,
+		"_obj":      `{"a":1}`,
+		"_nan":      "NaN",
+		"_b_d":      int64(3),
+		"_raw":      int64(4),
+	}
+	if !reflect.DeepEqual(s.Extra, expected) || s.RawExtra != nil {
+		t.Errorf("Extra %v, expected %v", s.Extra, expected)
+	}
+	if len(m.Extra) != 6 || m.Host != " " {
+		t.Errorf("original message changed")
+	}
+}
+
+func TestWriterValidation(t *testing.T) {
+	conn := &datagramConn{chunks: newChunkTable()}
+	w, err := newWriter(conn, nil)
+	if err != nil {
+		t.Fatalf("newWriter: %s", err)
+	}
+
+	w.Validation = ValidateReject
+	if err := w.WriteMessage(invalidMessage()); err == nil {
+		t.Errorf("invalid message sent")
+	} else if _, ok := err.(ValidationError); !ok {
+		t.Errorf("WriteMessage: expected ValidationError, got %T %v", err, err)
+	}
+	if err := w.Info("valid"); err != nil {
+		t.Errorf("Info: %s", err)
+	}
+
+	w.Validation = ValidateSanitize
+	if err := w.WriteMessage(invalidMessage()); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if len(conn.msgs) != 2 {
+		t.Fatalf("%d messages sent, expected 2", len(conn.msgs))
+	}
+	if msg := conn.msgs[1]; msg.Host != w.hostname || msg.Extra["__id"] != int64(2) {
+		t.Errorf("not sanitized: %+v", msg)
+	}
+}
@@ -9,16 +9,21 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"net/http"
 	"os"
 	"path"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,12 +31,80 @@ import (
 // messages to a graylog2 server, or data from a stream-oriented
 // interface (like the functions in log).
 type Writer struct {
-	mu               sync.Mutex
+	mu               chan struct{}
 	conn             net.Conn
 	hostname         string
 	Facility         string // defaults to current process name
 	CompressionLevel int    // one of the consts from compress/flate
 	CompressionType  CompressType
+
+	// ChunkSize is the largest datagram a UDP Writer sends, chunk
+	// header included; larger messages are chunked.  It defaults to
+	// the ChunkSize constant, which suits Ethernet, and may be raised
+	// for jumbo frames or lowered for tunnels.  With PathMTU set, the
+	// size is instead derived from the path MTU to the server if the
+	// system reports it (only Linux does), and ChunkSize is the
+	// fallback.
+	ChunkSize int
+	PathMTU   bool
+
+	// Oversize decides what a UDP Writer does with messages that
+	// would need more than the 128 chunks GELF allows.
+	Oversize OversizePolicy
+
+	// Validation decides whether messages are checked against the
+	// GELF specification before they are sent, see Message.Validate.
+	Validation ValidationPolicy
+
+	// Clock, if set, replaces time.Now for the timestamps of the
+	// messages built by Write and the leveled methods, such as to
+	// make tests deterministic.
+	Clock func() time.Time
+
+	// Reconnection policy of TCP and TLS writers, see reconnect.go.
+	// After a failed redial, further attempts are delayed by
+	// ReconnectDelay, doubling (with jitter) on every failure up to
+	// MaxReconnectDelay.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+
+	// OnDisconnect and OnReconnect, if set, are called when a TCP or
+	// TLS connection fails and once it has been re-established after
+	// the given number of dial attempts.  They are called with the
+	// Writer locked and must not write to it.
+	OnDisconnect func(err error)
+	OnReconnect  func(attempts int)
+
+	// OnError, if set, is called with the errors of messages sent in
+	// the background by an asynchronous Writer, see StartAsync.
+	OnError func(err error)
+
+	// Spool, if set, keeps the messages a TCP or TLS Writer failed to
+	// send and replays them, in order, once the server is reachable
+	// again.  See OpenSpool.
+	Spool *Spool
+
+	// Header holds extra headers, such as Authorization, that an HTTP
+	// Writer adds to every request.
+	Header http.Header
+
+	// MaxRetries is how many times an HTTP Writer retries a request
+	// that failed with a network error or a 5xx status, waiting as
+	// set by ReconnectDelay in between.
+	MaxRetries int
+
+	http      *httpTransport // non-nil for the HTTP transport
+	dial      dialFunc       // non-nil for stream transports
+	connMu    sync.Mutex     // guards conn and closed
+	closed    bool
+	attempts  int       // failed dials since the connection was lost
+	nextDial  time.Time // no redial before this
+	lastError error     // cause of the last failed dial
+
+	async    *asyncQueue  // non-nil once StartAsync was called
+	defaults atomic.Value // *fieldSet, see SetDefaultFields
+
+	leveled // Emerg, Info and the like, with w set to the Writer
 }
 
 // What compression type the writer should use when sending messages
@@ -52,20 +125,18 @@ type Message struct {
 	Short    string                 `json:"short_message"`
 	Full     string                 `json:"full_message,omitempty"`
 	TimeUnix float64                `json:"timestamp"`
-	Level    int32                  `json:"level,omitempty"`
+	Level    int32                  `json:"level"`
 	Facility string                 `json:"facility,omitempty"`
 	Extra    map[string]interface{} `json:"-"`
 	RawExtra json.RawMessage        `json:"-"`
 }
 
-// Used to control GELF chunking.  Should be less than (MTU - len(UDP
-// header)).
-//
-// TODO: generate dynamically using Path MTU Discovery?
+// Used to control GELF chunking.  ChunkSize is the default size of the
+// datagrams a Writer sends, header included, see Writer.ChunkSize.
+// Should be less than (MTU - len(IP and UDP headers)).
 const (
 	ChunkSize        = 1420
 	chunkedHeaderLen = 12
-	chunkedDataLen   = ChunkSize - chunkedHeaderLen
 )
 
 var (
@@ -88,26 +159,79 @@ const (
 
 // numChunks returns the number of GELF chunks necessary to transmit
 // the given compressed buffer.
-func numChunks(b []byte) int {
+func numChunks(b []byte, chunkSize int) int {
 	lenB := len(b)
-	if lenB <= ChunkSize {
+	if lenB <= chunkSize {
 		return 1
 	}
-	return len(b)/chunkedDataLen + 1
+	dataLen := chunkSize - chunkedHeaderLen
+	return (lenB + dataLen - 1) / dataLen
 }
 
 // New returns a new GELF Writer.  This writer can be used to send the
 // output of the standard Go log functions to a central GELF server by
 // passing it to log.SetOutput()
 func NewWriter(addr string) (*Writer, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newWriter(conn, nil)
+}
+
+// NewTCPWriter returns a new GELF Writer that sends messages to a GELF
+// TCP input.  As required by the GELF TCP transport, every message is
+// sent as uncompressed JSON terminated by a null byte, so
+// CompressionType and CompressionLevel are ignored.  If the connection
+// fails it is transparently redialed, see ReconnectDelay.
+func NewTCPWriter(addr string) (*Writer, error) {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	conn, err := dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return newWriter(conn, dial)
+}
+
+// NewTLSWriter returns a new GELF Writer that sends messages to a GELF
+// TCP input secured with TLS, framed exactly as with NewTCPWriter.
+// config controls certificate verification: set RootCAs to trust a
+// private CA, Certificates to present a client certificate for mutual
+// TLS, and ServerName if it differs from the host part of addr.  A nil
+// config uses the system roots and verifies the host name from addr.
+func NewTLSWriter(addr string, config *tls.Config) (*Writer, error) {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return dialTLS(ctx, addr, config)
+	}
+	conn, err := dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return newWriter(conn, dial)
+}
+
+// newWriter returns a Writer sending to conn.  dial is nil for UDP,
+// otherwise messages are null-byte framed and dial is used to
+// reconnect.  conn is nil for HTTP writers.
+func newWriter(conn net.Conn, dial dialFunc) (*Writer, error) {
 	var err error
 	w := new(Writer)
+	w.mu = make(chan struct{}, 1)
+	w.leveled.w = w
+	w.conn = conn
+	w.dial = dial
 	w.CompressionLevel = flate.BestSpeed
+	w.ChunkSize = ChunkSize
+	w.ReconnectDelay = DefaultReconnectDelay
+	w.MaxReconnectDelay = DefaultMaxReconnectDelay
 
-	if w.conn, err = net.Dial("udp", addr); err != nil {
-		return nil, err
-	}
 	if w.hostname, err = os.Hostname(); err != nil {
+		if conn != nil {
+			conn.Close()
+		}
 		return nil, err
 	}
 
@@ -122,11 +246,12 @@ func NewWriter(addr string) (*Writer, error) {
 //
 //     2-byte magic (0x1e 0x0f), 8 byte id, 1 byte sequence id, 1 byte
 //     total, chunk-data
-func (w *Writer) writeChunked(zBytes []byte) (err error) {
-	b := make([]byte, 0, ChunkSize)
+func (w *Writer) writeChunked(zBytes []byte, chunkSize int) (err error) {
+	b := make([]byte, 0, chunkSize)
 	buf := bytes.NewBuffer(b)
-	nChunksI := numChunks(zBytes)
-	if nChunksI > 128 {
+	chunkedDataLen := chunkSize - chunkedHeaderLen
+	nChunksI := numChunks(zBytes, chunkSize)
+	if nChunksI > maxChunks {
 		return fmt.Errorf("msg too large, would need %d chunks", nChunksI)
 	}
 	nChunks := uint8(nChunksI)
@@ -197,76 +322,138 @@ func newBuffer() *bytes.Buffer {
 // filled out appropriately.  In general, clients will want to use
 // Write, rather than WriteMessage.
 func (w *Writer) WriteMessage(m *Message) (err error) {
+	return w.WriteMessageContext(context.Background(), m)
+}
+
+// WriteMessageContext is like WriteMessage, but gives up once ctx is
+// done, returning ctx.Err().  With TCP and TLS, ctx bounds redialing
+// as well as the write itself, and with HTTP the whole request
+// including retries.  An asynchronous Writer only waits for room in
+// its queue until ctx is done.
+func (w *Writer) WriteMessageContext(ctx context.Context, m *Message) (err error) {
+	return w.writeMessage(ctx, m, nil)
+}
+
+// writeMessage sends m with the fields of a Logger, which may be nil,
+// and the default fields.
+func (w *Writer) writeMessage(ctx context.Context, m *Message, fields *fieldSet) (err error) {
+	switch w.Validation {
+	case ValidateReject:
+		if err = m.Validate(); err != nil {
+			return err
+		}
+	case ValidateSanitize:
+		if m.Validate() != nil {
+			m = m.Sanitize(w.hostname)
+		}
+	}
+
 	mBuf := newBuffer()
 	defer bufPool.Put(mBuf)
-	if err = m.MarshalJSONBuf(mBuf); err != nil {
+	if err = w.marshal(m, mBuf, fields, w.defaultFields()); err != nil {
+		return err
+	}
+	if w.async != nil {
+		return w.async.enqueue(ctx, append([]byte(nil), mBuf.Bytes()...))
+	}
+	return w.send(ctx, mBuf.Bytes())
+}
+
+// send compresses the serialized message mBytes as configured and
+// writes it to the connection.  mBytes may be appended to.
+func (w *Writer) send(ctx context.Context, mBytes []byte) (err error) {
+	if w.dial != nil {
+		// GELF TCP frames are never compressed or chunked, the
+		// null byte alone delimits messages.
+		return w.writeFrame(ctx, append(mBytes, 0))
+	}
+
+	zBuf := newBuffer()
+	defer bufPool.Put(zBuf)
+	zBytes, err := w.compress(mBytes, zBuf)
+	if err != nil {
+		return err
+	}
+	if w.http != nil {
+		return w.post(ctx, zBytes)
+	}
+
+	// UDP writes don't block, and the connection is shared by
+	// concurrent writers, so deadlines are out of the question
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	chunkSize := w.chunkSize()
+	if numChunks(zBytes, chunkSize) > maxChunks && w.Oversize != OversizeError {
+		return w.sendOversized(mBytes, len(zBytes), chunkSize)
+	}
+	return w.writeDatagrams(zBytes, chunkSize)
+}
+
+// writeDatagrams sends the compressed message zBytes over UDP,
+// chunked if it is larger than chunkSize.
+func (w *Writer) writeDatagrams(zBytes []byte, chunkSize int) error {
+	if numChunks(zBytes, chunkSize) > 1 {
+		return w.writeChunked(zBytes, chunkSize)
+	}
+	n, err := w.conn.Write(zBytes)
+	if err != nil {
 		return err
 	}
-	mBytes := mBuf.Bytes()
+	if n != len(zBytes) {
+		return fmt.Errorf("bad write (%d/%d)", n, len(zBytes))
+	}
 
-	var (
-		zBuf   *bytes.Buffer
-		zBytes []byte
-	)
+	return nil
+}
 
+// compress returns mBytes compressed with CompressionType, using zBuf
+// as the output buffer.
+func (w *Writer) compress(mBytes []byte, zBuf *bytes.Buffer) (zBytes []byte, err error) {
 	var zw io.WriteCloser
 	switch w.CompressionType {
 	case CompressGzip:
-		zBuf = newBuffer()
-		defer bufPool.Put(zBuf)
 		zw, err = gzip.NewWriterLevel(zBuf, w.CompressionLevel)
 	case CompressZlib:
-		zBuf = newBuffer()
-		defer bufPool.Put(zBuf)
 		zw, err = zlib.NewWriterLevel(zBuf, w.CompressionLevel)
 	case CompressNone:
-		zBytes = mBytes
+		return mBytes, nil
 	default:
 		panic(fmt.Sprintf("unknown compression type %d",
 			w.CompressionType))
 	}
-	if zw != nil {
-		if err != nil {
-			return
-		}
-		if _, err = zw.Write(mBytes); err != nil {
-			zw.Close()
-			return
-		}
-		zw.Close()
-		zBytes = zBuf.Bytes()
-	}
-
-	if numChunks(zBytes) > 1 {
-		return w.writeChunked(zBytes)
-	}
-	n, err := w.conn.Write(zBytes)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if n != len(zBytes) {
-		return fmt.Errorf("bad write (%d/%d)", n, len(zBytes))
+	if _, err = zw.Write(mBytes); err != nil {
+		zw.Close()
+		return nil, err
 	}
-
-	return nil
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return zBuf.Bytes(), nil
 }
 
-// Close connection and interrupt blocked Read or Write operations
+// Close connection and interrupt blocked Read or Write operations.
+// An asynchronous Writer first sends all queued messages.
 func (w *Writer) Close() error {
-	return w.conn.Close()
-}
+	if w.async != nil {
+		w.async.close()
+	}
+
+	w.connMu.Lock()
+	conn := w.conn
+	w.closed = true
+	w.connMu.Unlock()
 
-/*
-func (w *Writer) Alert(m string) (err error)
-func (w *Writer) Close() error
-func (w *Writer) Crit(m string) (err error)
-func (w *Writer) Debug(m string) (err error)
-func (w *Writer) Emerg(m string) (err error)
-func (w *Writer) Err(m string) (err error)
-func (w *Writer) Info(m string) (err error)
-func (w *Writer) Notice(m string) (err error)
-func (w *Writer) Warning(m string) (err error)
-*/
+	// a stream writer may be between connections
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
 
 // getCaller returns the filename and the line info of a function
 // further down in the call stack.  Passing 0 in as callDepth would
@@ -329,7 +516,7 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 		Host:     w.hostname,
 		Short:    string(short),
 		Full:     string(full),
-		TimeUnix: float64(time.Now().Unix()),
+		TimeUnix: unixTime(w.now()),
 		Level:    6, // info
 		Facility: w.Facility,
 		Extra: map[string]interface{}{
@@ -345,6 +532,31 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// SetTime sets the timestamp of m to t, with microsecond precision.
+func (m *Message) SetTime(t time.Time) {
+	m.TimeUnix = unixTime(t)
+}
+
+// Time returns the timestamp of m, rounded to the microsecond.
+func (m *Message) Time() time.Time {
+	us := int64(math.Floor(m.TimeUnix*1e6 + 0.5))
+	return time.Unix(us/1e6, us%1e6*1e3)
+}
+
+// unixTime returns t as GELF timestamp: seconds since the epoch, with
+// the microseconds as decimal places.
+func unixTime(t time.Time) float64 {
+	return float64(t.UnixNano()/1e3) / 1e6
+}
+
+// now returns the current time of w's Clock.
+func (w *Writer) now() time.Time {
+	if w.Clock != nil {
+		return w.Clock()
+	}
+	return time.Now()
+}
+
 func (m *Message) MarshalJSONBuf(buf *bytes.Buffer) error {
 	b, err := json.Marshal(m)
 	if err != nil {
@@ -384,35 +596,14 @@ func (m *Message) MarshalJSONBuf(buf *bytes.Buffer) error {
 	return buf.WriteByte('}')
 }
 
+// UnmarshalJSON decodes a GELF message.  Fields with the type of a
+// common mistake are converted, such as a level or timestamp sent as
+// string or a numeric host; fields that cannot be converted fail with
+// a *FieldError.  See UnmarshalJSONStrict for rejecting those too.
+//
+// Integers in additional fields decode to int64, so that IDs and
+// nanosecond timestamps keep their precision, and other numbers to
+// float64.  Integers beyond int64 are kept as json.Number.
 func (m *Message) UnmarshalJSON(data []byte) error {
-	i := make(map[string]interface{}, 16)
-	if err := json.Unmarshal(data, &i); err != nil {
-		return err
-	}
-	for k, v := range i {
-		if k[0] == '_' {
-			if m.Extra == nil {
-				m.Extra = make(map[string]interface{}, 1)
-			}
-			m.Extra[k] = v
-			continue
-		}
-		switch k {
-		case "version":
-			m.Version = v.(string)
-		case "host":
-			m.Host = v.(string)
-		case "short_message":
-			m.Short = v.(string)
-		case "full_message":
-			m.Full = v.(string)
-		case "timestamp":
-			m.TimeUnix = v.(float64)
-		case "level":
-			m.Level = int32(v.(float64))
-		case "facility":
-			m.Facility = v.(string)
-		}
-	}
-	return nil
+	return m.unmarshal(data, false)
 }
@@ -5,13 +5,24 @@
 package gelf
 
 import (
+	"bufio"
+	"bytes"
 	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"strings"
 	"testing"
 	"time"
@@ -63,6 +74,345 @@ func sendAndRecvMsg(msg *Message, compress CompressType) (*Message, error) {
 	return r.ReadMessage()
 }
 
+// tcpFrames accepts connections on l and sends every null-terminated
+// frame it receives on the returned channel.
+func tcpFrames(l net.Listener) <-chan []byte {
+	frames := make(chan []byte, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					frame, err := br.ReadBytes(0)
+					if err != nil {
+						return
+					}
+					frames <- frame
+				}
+			}()
+		}
+	}()
+	return frames
+}
+
+// tests that the TCP writer sends uncompressed, null-terminated frames
+// regardless of size
+func TestTCPWriter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	frames := tcpFrames(l)
+
+	w, err := NewTCPWriter(l.Addr().String())
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+	w.CompressionType = CompressGzip
+
+	randData := make([]byte, 4096)
+	if _, err := rand.Read(randData); err != nil {
+		t.Fatalf("cannot get random data: %s", err)
+	}
+	big := "awesomesauce\n" + base64.StdEncoding.EncodeToString(randData)
+
+	for _, msgData := range []string{"some awesome thing", big} {
+		if _, err = w.Write([]byte(msgData)); err != nil {
+			t.Fatalf("w.Write: %s", err)
+		}
+
+		frame := <-frames
+		if len(frame) == 0 || frame[len(frame)-1] != 0 {
+			t.Fatalf("frame not null-terminated: %q", frame)
+		}
+		var msg Message
+		if err := json.Unmarshal(frame[:len(frame)-1], &msg); err != nil {
+			t.Fatalf("json.Unmarshal: %s", err)
+		}
+		if msg.Short != strings.SplitN(msgData, "\n", 2)[0] {
+			t.Errorf("msg.Short: expected %s, got %s", msgData, msg.Short)
+		}
+	}
+}
+
+// tests that a TCP writer redials after the server went away, and
+// backs off while it cannot reach it
+func TestTCPWriterReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := l.Addr().String()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	w, err := NewTCPWriter(addr)
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+	w.ReconnectDelay = time.Hour
+	w.MaxReconnectDelay = time.Hour
+	var disconnects, reconnects int
+	w.OnDisconnect = func(err error) { disconnects++ }
+	w.OnReconnect = func(attempts int) { reconnects++ }
+
+	// take the server down, a write fails once the peer's reset
+	// arrives and redialing is delayed from then on
+	l.Close()
+	(<-accepted).Close()
+	for i := 0; err == nil && i < 100; i++ {
+		_, err = w.Write([]byte("lost"))
+		time.Sleep(time.Millisecond)
+	}
+	if err == nil || disconnects != 1 {
+		t.Fatalf("no disconnect noticed (%d): %v", disconnects, err)
+	}
+	if _, err = w.Write([]byte("lost")); err == nil || w.attempts != 1 {
+		t.Fatalf("redialed during backoff (%d attempts): %v", w.attempts, err)
+	}
+
+	// bring the server back, the next write after the delay goes
+	// through on a new connection
+	if l, err = net.Listen("tcp", addr); err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	frames := tcpFrames(l)
+	w.nextDial = time.Time{}
+
+	if _, err = w.Write([]byte("second")); err != nil {
+		t.Fatalf("w.Write after restart: %s", err)
+	}
+	if reconnects != 1 {
+		t.Errorf("OnReconnect called %d times", reconnects)
+	}
+	var msg Message
+	if err := json.Unmarshal(bytes.TrimSuffix(<-frames, []byte{0}), &msg); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if msg.Short != "second" {
+		t.Errorf("msg.Short: expected second, got %s", msg.Short)
+	}
+}
+
+// tests that a write blocked by a peer that doesn't read is
+// interrupted by the deadline of its context
+func TestTCPWriterContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	w, err := NewTCPWriter(l.Addr().String())
+	if err != nil {
+		t.Fatalf("NewTCPWriter: %s", err)
+	}
+	defer w.Close()
+	if conn := <-accepted; conn != nil {
+		defer conn.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	m := &Message{
+		Version: "1.1",
+		Host:    "h",
+		Short:   strings.Repeat("x", 1<<20),
+	}
+	for i := 0; err == nil && i < 1000; i++ {
+		err = w.WriteMessageContext(ctx, m)
+	}
+	if err != context.DeadlineExceeded {
+		t.Fatalf("WriteMessageContext: expected deadline exceeded, got %v", err)
+	}
+
+	// the connection was dropped, and a done context keeps us from
+	// redialing
+	if err = w.WriteMessageContext(ctx, m); err != context.DeadlineExceeded {
+		t.Errorf("WriteMessageContext after deadline: %v", err)
+	}
+}
+
+// tests that a dial cut short by the context of a write neither
+// counts as a failed attempt nor delays the next write
+func TestTCPWriterContextDial(t *testing.T) {
+	dials := 0
+	w, err := newWriter(nil, func(ctx context.Context) (net.Conn, error) {
+		dials++
+		if dials == 1 {
+			<-ctx.Done()
+			return nil, errors.New("dial tcp: i/o timeout")
+		}
+		return nil, errors.New("connection refused")
+	})
+	if err != nil {
+		t.Fatalf("newWriter: %s", err)
+	}
+	m := &Message{Version: "1.1", Host: "h", Short: "hi"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := w.WriteMessageContext(ctx, m); err != context.DeadlineExceeded {
+		t.Errorf("WriteMessageContext: expected deadline exceeded, got %v", err)
+	}
+	err = w.WriteMessage(m)
+	if dials != 2 || err == nil || !strings.Contains(err.Error(), "attempt 1") {
+		t.Errorf("after %d dials: %v", dials, err)
+	}
+}
+
+// tests that a write waiting for another one stuck dialing gives up
+// when its context is done
+func TestTCPWriterContextWait(t *testing.T) {
+	dialing, release := make(chan struct{}), make(chan struct{})
+	w, err := newWriter(nil, func(ctx context.Context) (net.Conn, error) {
+		close(dialing)
+		<-release
+		return nil, errors.New("released")
+	})
+	if err != nil {
+		t.Fatalf("newWriter: %s", err)
+	}
+	m := &Message{Version: "1.1", Host: "h", Short: "hi"}
+
+	first := make(chan error, 1)
+	go func() {
+		first <- w.WriteMessageContext(context.Background(), m)
+	}()
+	<-dialing
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := w.WriteMessageContext(ctx, m); err != context.DeadlineExceeded {
+		t.Errorf("WriteMessageContext: expected deadline exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("WriteMessageContext returned after %s", d)
+	}
+
+	close(release)
+	if err := <-first; err == nil {
+		t.Errorf("first WriteMessageContext succeeded")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	w := &Writer{ReconnectDelay: time.Second, MaxReconnectDelay: 5 * time.Second}
+	for i, max := range []time.Duration{1, 2, 4, 5, 5, 5} {
+		attempts := i + 1
+		max *= time.Second
+		if d := w.backoff(attempts); d < max/2 || d > max {
+			t.Errorf("backoff(%d) = %s, expected within [%s, %s]",
+				attempts, d, max/2, max)
+		}
+	}
+}
+
+// testCert issues a certificate for 127.0.0.1 signed by parent, or a
+// self-signed CA certificate if parent is nil.
+func testCert(t testing.TB, parent *tls.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "go-gelf test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// testTLSConfigs returns a server config requiring client certificates
+// and a client config trusting the server, both signed by one test CA.
+func testTLSConfigs(t testing.TB) (server, client *tls.Config) {
+	ca := testCert(t, nil, x509.ExtKeyUsageAny)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, &ca, x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, &ca, x509.ExtKeyUsageClientAuth)},
+		RootCAs:      pool,
+	}
+	return server, client
+}
+
+// tests that the TLS writer verifies the server, presents a client
+// certificate and sends null-terminated frames
+func TestTLSWriter(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	frames := tcpFrames(l)
+
+	if _, err := NewTLSWriter(l.Addr().String(), nil); err == nil {
+		t.Fatalf("NewTLSWriter didn't fail for an untrusted server")
+	}
+
+	w, err := NewTLSWriter(l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("NewTLSWriter: %s", err)
+	}
+	defer w.Close()
+
+	if _, err = w.Write([]byte("secret thing")); err != nil {
+		t.Fatalf("w.Write: %s", err)
+	}
+	frame := <-frames
+	var msg Message
+	if err := json.Unmarshal(bytes.TrimSuffix(frame, []byte{0}), &msg); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if msg.Short != "secret thing" {
+		t.Errorf("msg.Short: expected %s, got %s", "secret thing", msg.Short)
+	}
+}
+
 // tests single-message (non-chunked) messages that are split over
 // multiple lines
 func TestWriteSmallMultiLine(t *testing.T) {
@@ -169,13 +519,114 @@ func TestWriteBigChunked(t *testing.T) {
 	}
 }
 
+// tests that UDP messages are chunked as set by the Writer's ChunkSize
+func TestChunkSize(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	w.CompressionType = CompressNone
+
+	// 4000 bytes take 9 chunks of 500, or a single datagram
+	for _, tt := range []struct{ size, chunks int }{{500, 9}, {9000, 0}} {
+		w.ChunkSize = tt.size
+		short := strings.Repeat("x", 4000)
+		if _, err := w.Write([]byte(short)); err != nil {
+			t.Fatalf("w.Write: %s", err)
+		}
+		msg, meta, err := r.ReadMessageMeta()
+		if err != nil {
+			t.Fatalf("ReadMessageMeta: %s", err)
+		}
+		if msg.Short != short {
+			t.Errorf("ChunkSize %d: message garbled", tt.size)
+		}
+		if meta.Chunks != tt.chunks {
+			t.Errorf("ChunkSize %d: %d chunks, expected %d", tt.size, meta.Chunks, tt.chunks)
+		}
+	}
+
+	// never larger than a UDP datagram can carry
+	w.ChunkSize = 70000
+	if size := w.chunkSize(); size != 65507 {
+		t.Errorf("ChunkSize 70000: chunk size %d, expected 65507", size)
+	}
+}
+
+func TestNumChunks(t *testing.T) {
+	dataLen := ChunkSize - chunkedHeaderLen
+	for _, tt := range []struct{ size, chunks int }{
+		{ChunkSize, 1},
+		{ChunkSize + 1, 2},
+		{2 * dataLen, 2},
+		{2*dataLen + 1, 3},
+	} {
+		if n := numChunks(make([]byte, tt.size), ChunkSize); n != tt.chunks {
+			t.Errorf("numChunks(%d bytes) = %d, expected %d", tt.size, n, tt.chunks)
+		}
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 30, 15, 123456789, time.UTC)
+	var m Message
+	m.SetTime(now)
+
+	var mBuf bytes.Buffer
+	if err := m.MarshalJSONBuf(&mBuf); err != nil {
+		t.Fatalf("MarshalJSONBuf: %s", err)
+	}
+	if !bytes.Contains(mBuf.Bytes(), []byte(`"timestamp":1488371415.123456`)) {
+		t.Errorf("timestamp not in microseconds: %s", mBuf.Bytes())
+	}
+	var m2 Message
+	if err := json.Unmarshal(mBuf.Bytes(), &m2); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if expected := now.Truncate(time.Microsecond); !m2.Time().Equal(expected) {
+		t.Errorf("Time: expected %s, got %s", expected, m2.Time())
+	}
+}
+
+func TestClock(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReader: %s", err)
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.Close()
+	now := time.Date(2017, 3, 1, 12, 30, 15, 250000000, time.UTC)
+	w.Clock = func() time.Time { return now }
+
+	w.Write([]byte("write"))
+	w.Info("info")
+	for i := 0; i < 2; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if !msg.Time().Equal(now) {
+			t.Errorf("%s: expected %s, got %s", msg.Short, now, msg.Time())
+		}
+	}
+}
+
 // tests messages with extra data
 func TestExtraData(t *testing.T) {
 
-	// time.Now().Unix() seems fine, UnixNano() won't roundtrip
-	// through string -> float64 -> int64
+	// integers are decoded as int64, so even UnixNano() roundtrips
 	extra := map[string]interface{}{
-		"_a":    10 * time.Now().Unix(),
+		"_a":    time.Now().UnixNano(),
 		"C":     9,
 		"_file": "writer_test.go",
 		"_line": 186,
@@ -217,8 +668,8 @@ func TestExtraData(t *testing.T) {
 			return
 		}
 
-		if int64(msg.Extra["_a"].(float64)) != extra["_a"].(int64) {
-			t.Errorf("_a didn't roundtrip (%v != %v)", int64(msg.Extra["_a"].(float64)), extra["_a"].(int64))
+		if msg.Extra["_a"] != extra["_a"] {
+			t.Errorf("_a didn't roundtrip (%v != %v)", msg.Extra["_a"], extra["_a"])
 			return
 		}
 
@@ -227,8 +678,8 @@ func TestExtraData(t *testing.T) {
 			return
 		}
 
-		if int(msg.Extra["_line"].(float64)) != extra["_line"].(int) {
-			t.Errorf("_line didn't roundtrip (%v != %v)", int(msg.Extra["_line"].(float64)), extra["_line"].(int))
+		if msg.Extra["_line"] != int64(extra["_line"].(int)) {
+			t.Errorf("_line didn't roundtrip (%v != %v)", msg.Extra["_line"], extra["_line"])
 			return
 		}
 	}